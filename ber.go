@@ -0,0 +1,211 @@
+package trauth
+
+import (
+	"fmt"
+	"io"
+)
+
+// ber tag classes and the constructed bit, as used by LDAP.
+const (
+	berApplication = 0x40
+	berContext     = 0x80
+	berConstructed = 0x20
+
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+)
+
+// berMaxMessage caps the size of a single message read from a peer.
+const berMaxMessage = 1 << 20
+
+// berPacket is a decoded BER element. Constructed elements have their
+// children decoded, primitive ones keep their raw value.
+type berPacket struct {
+	tag      byte
+	value    []byte
+	children []*berPacket
+}
+
+// berLength encodes a definite length.
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// berTLV encodes an element from its tag and content.
+func berTLV(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+// berInt encodes an integer with the given tag.
+func berInt(tag byte, v int) []byte {
+	if v == 0 {
+		return berTLV(tag, []byte{0})
+	}
+
+	var b []byte
+	for n := v; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	// keep positive numbers positive
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+
+	return berTLV(tag, b)
+}
+
+// berString encodes an octet string with the given tag.
+func berString(tag byte, v string) []byte {
+	return berTLV(tag, []byte(v))
+}
+
+// berBool encodes a boolean.
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(berBoolean, []byte{0xff})
+	}
+
+	return berTLV(berBoolean, []byte{0x00})
+}
+
+// parseBER decodes one element, returning it and the bytes after it.
+func parseBER(b []byte, depth int) (*berPacket, []byte, error) {
+
+	if depth > 32 {
+		return nil, nil, fmt.Errorf("ber data nested too deep")
+	}
+
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("unexpected end of ber data")
+	}
+
+	p := &berPacket{tag: b[0]}
+	if p.tag&0x1f == 0x1f {
+		return nil, nil, fmt.Errorf("multi-byte ber tags are not supported")
+	}
+
+	length, n, err := berReadLength(b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b = b[1+n:]
+	if length > len(b) {
+		return nil, nil, fmt.Errorf("unexpected end of ber data")
+	}
+
+	p.value, b = b[:length], b[length:]
+
+	if p.tag&berConstructed != 0 {
+		for rest := p.value; len(rest) > 0; {
+			var child *berPacket
+			if child, rest, err = parseBER(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			p.children = append(p.children, child)
+		}
+	}
+
+	return p, b, nil
+}
+
+// berReadLength decodes a definite length, returning it and the number
+// of bytes it took.
+func berReadLength(b []byte) (int, int, error) {
+
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("unexpected end of ber data")
+	}
+
+	if b[0] < 0x80 {
+		return int(b[0]), 1, nil
+	}
+
+	n := int(b[0] & 0x7f)
+	if n == 0 || n > 4 || len(b) < 1+n {
+		return 0, 0, fmt.Errorf("unsupported ber length")
+	}
+
+	length := 0
+	for _, c := range b[1 : 1+n] {
+		length = length<<8 | int(c)
+	}
+
+	if length > berMaxMessage {
+		return 0, 0, fmt.Errorf("ber element too large")
+	}
+
+	return length, 1 + n, nil
+}
+
+// readBER reads a single complete element from a stream.
+func readBER(r io.Reader) (*berPacket, error) {
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	raw := head
+	if head[1]&0x80 != 0 {
+		extra := make([]byte, head[1]&0x7f)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, err
+		}
+
+		raw = append(raw, extra...)
+	}
+
+	length, _, err := berReadLength(raw[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	p, _, err := parseBER(append(raw, body...), 0)
+
+	return p, err
+}
+
+// int decodes the value of an integer or enumerated element.
+func (p *berPacket) int() int {
+	n := 0
+	for _, c := range p.value {
+		n = n<<8 | int(c)
+	}
+
+	return n
+}
+
+// child returns the nth child of a constructed element, or an empty
+// element if there is no such child.
+func (p *berPacket) child(n int) *berPacket {
+	if n < len(p.children) {
+		return p.children[n]
+	}
+
+	return &berPacket{}
+}
@@ -0,0 +1,168 @@
+package trauth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth limits how deeply nested decoded values may be.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes a single CBOR (RFC 8949) value, returning it along
+// with the bytes that follow it. It supports the subset of CBOR used by
+// WebAuthn attestation objects and COSE keys: integers, byte and text
+// strings, arrays, maps and simple values. Map keys are kept as
+// interface{} values, as COSE keys use integers.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return cborValue(b, 0)
+}
+
+// cborHead reads the initial byte and argument of a data item.
+func cborHead(b []byte) (byte, uint64, []byte, error) {
+
+	if len(b) == 0 {
+		return 0, 0, nil, fmt.Errorf("unexpected end of cbor data")
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	var n int
+	switch {
+	case info < 24:
+		return major, uint64(info), b, nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, 0, nil, fmt.Errorf("unsupported cbor argument %d", info)
+	}
+
+	if len(b) < n {
+		return 0, 0, nil, fmt.Errorf("unexpected end of cbor data")
+	}
+
+	var arg uint64
+	for _, c := range b[:n] {
+		arg = arg<<8 | uint64(c)
+	}
+
+	return major, arg, b[n:], nil
+}
+
+func cborValue(b []byte, depth int) (interface{}, []byte, error) {
+
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("cbor data nested too deep")
+	}
+
+	// floats need the raw argument bytes, check for them first
+	if len(b) > 0 && b[0]>>5 == 7 {
+		switch b[0] & 0x1f {
+		case 26:
+			if len(b) < 5 {
+				return nil, nil, fmt.Errorf("unexpected end of cbor data")
+			}
+
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b[1:5]))), b[5:], nil
+		case 27:
+			if len(b) < 9 {
+				return nil, nil, fmt.Errorf("unexpected end of cbor data")
+			}
+
+			return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), b[9:], nil
+		}
+	}
+
+	major, arg, rest, err := cborHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer out of range")
+		}
+
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer out of range")
+		}
+
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if uint64(len(rest)) < arg {
+			return nil, nil, fmt.Errorf("unexpected end of cbor data")
+		}
+
+		if major == 3 {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+
+		return append([]byte(nil), rest[:arg]...), rest[arg:], nil
+	case 4:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor array too long")
+		}
+
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = cborValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor map too long")
+		}
+
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v interface{}
+			if k, rest, err = cborValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported cbor map key")
+			}
+
+			if v, rest, err = cborValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			m[k] = v
+		}
+
+		return m, rest, nil
+	case 6:
+		// tags are ignored, the tagged value is returned as is
+		return cborValue(rest, depth+1)
+	case 7:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unsupported cbor data item %d/%d", major, arg)
+}
@@ -4,8 +4,8 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
-	"regexp"
 	"strings"
 
 	"github.com/gorilla/securecookie"
@@ -22,9 +22,28 @@ type Config struct {
 
 	// Logging options
 	LogUnauthenticated bool `yaml:"logunauthenticated"`
+	Debug              bool `yaml:"debug"`
+	DecisionHeader     bool `yaml:"decisionheader"`
+
+	// Session options
+	LoginPassThrough     bool `yaml:"loginpassthrough"`
+	ForwardHeaders       bool `yaml:"forwardheaders"`
+	BindSessionIP        bool `yaml:"bindsessionip"`
+	BindSessionUserAgent bool `yaml:"bindsessionuseragent"`
+	SessionIPv4Prefix    int  `yaml:"sessionipv4prefix"`
+	SessionIPv6Prefix    int  `yaml:"sessionipv6prefix"`
+
+	// Stateless authentication for machine clients
+	Stateless          string `yaml:"stateless"`
+	CredentialCacheTTL int    `yaml:"credentialcachettl"`
 
 	// The rules engine, used to bypass auth
-	Rules []Rule `yaml:"rules"`
+	Rules  []Rule  `yaml:"rules"`
+	IPSets []IPSet `yaml:"ipsets"`
+
+	// MaxMind DB files for country and asn rule conditions
+	GeoIPDB    string `yaml:"geoipdb"`
+	GeoIPASNDB string `yaml:"geoipasndb"`
 
 	// Values with internal defaults
 	CookieName     string `yaml:"cookiename"`
@@ -34,14 +53,110 @@ type Config struct {
 	CookieKey      string `yaml:"cookiekey"`
 	Realm          string `yaml:"realm"`
 
+	// LDAP directory to verify passwords against, alongside or
+	// instead of htpasswd users
+	LDAPURL                string `yaml:"ldapurl"`
+	LDAPBindDN             string `yaml:"ldapbinddn"`
+	LDAPBindPassword       string `yaml:"ldapbindpassword"`
+	LDAPBaseDN             string `yaml:"ldapbasedn"`
+	LDAPUserFilter         string `yaml:"ldapuserfilter"`
+	LDAPGroupAttribute     string `yaml:"ldapgroupattribute"`
+	LDAPGroupBaseDN        string `yaml:"ldapgroupbasedn"`
+	LDAPGroupFilter        string `yaml:"ldapgroupfilter"`
+	LDAPCAFile             string `yaml:"ldapcafile"`
+	LDAPInsecureSkipVerify bool   `yaml:"ldapinsecureskipverify"`
+	LDAPTimeout            int    `yaml:"ldaptimeout"`
+
+	// Passwordless logins with a link emailed to allowed addresses
+	EmailAllow   []string `yaml:"emailallow"`
+	EmailLinkTTL int      `yaml:"emaillinkttl"`
+	SMTPHost     string   `yaml:"smtphost"`
+	SMTPUsername string   `yaml:"smtpusername"`
+	SMTPPassword string   `yaml:"smtppassword"`
+	SMTPFrom     string   `yaml:"smtpfrom"`
+
+	// RADIUS servers to verify passwords against with PAP
+	RadiusServers            []string `yaml:"radiusservers"`
+	RadiusSecret             string   `yaml:"radiussecret"`
+	RadiusTimeout            int      `yaml:"radiustimeout"`
+	RadiusNASIdentifier      string   `yaml:"radiusnasidentifier"`
+	RadiusAllowNoMessageAuth bool     `yaml:"radiusallownomessageauth"`
+
+	// Static api tokens for machine clients
+	Tokens      []APIToken `yaml:"tokens"`
+	TokensFile  string     `yaml:"tokensfile"`
+	TokenHeader string     `yaml:"tokenheader"`
+
+	// JWT bearer tokens, verified with one of a key, a jwks file or a
+	// jwks url
+	JWTKeyFile       string `yaml:"jwtkeyfile"`
+	JWTJWKSFile      string `yaml:"jwtjwksfile"`
+	JWTJWKSURL       string `yaml:"jwtjwksurl"`
+	JWTJWKSRefresh   int    `yaml:"jwtjwksrefresh"`
+	JWTIssuer        string `yaml:"jwtissuer"`
+	JWTAudience      string `yaml:"jwtaudience"`
+	JWTUsernameClaim string `yaml:"jwtusernameclaim"`
+	JWTGroupsClaim   string `yaml:"jwtgroupsclaim"`
+
+	// Identities asserted by an authenticating proxy in front of trauth
+	TrustedHeader    string   `yaml:"trustedheader"`
+	TrustedProxies   []string `yaml:"trustedproxies"`
+	TrustedProxyCert string   `yaml:"trustedproxycert"`
+
+	// Signed identity tokens passed on to upstream services
+	IdentityKeyFile   string            `yaml:"identitykeyfile"`
+	IdentityAlgorithm string            `yaml:"identityalgorithm"`
+	IdentityIssuer    string            `yaml:"identityissuer"`
+	IdentityAudiences map[string]string `yaml:"identityaudiences"`
+	IdentityHeader    string            `yaml:"identityheader"`
+	IdentityTTL       int               `yaml:"identityttl"`
+
+	// TOTP second factor for password users
+	TOTPFile     string `yaml:"totpfile"`
+	TOTPRequired bool   `yaml:"totprequired"`
+
+	// WebAuthn / passkey authentication
+	WebAuthnFile string `yaml:"webauthnfile"`
+	WebAuthnRPID string `yaml:"webauthnrpid"`
+
 	// Cert authentication information
 	CAPath   string `yaml:"capath"`
 	CertPool *x509.CertPool
 
+	// Cross-domain single sign-on. A hub lists the domains it may issue
+	// tickets for, other domains point to the hub's url.
+	SSOHub       string   `yaml:"ssohub"`
+	SSODomains   []string `yaml:"ssodomains"`
+	SSOKey       string   `yaml:"ssokey"`
+	SSOTicketTTL int      `yaml:"ssotickettl"`
+
 	htpasswd    *htpasswd.File
+	ldap        *ldapDirectory
+	radius      *radiusClient
+	email       *emailLogin
+	tokens      *tokenStore
+	jwtKeys     *jwtKeySet
+	identity    *identitySigner
+	trustedNets []*net.IPNet
+	trustedCert []byte
 	cookieStore *sessions.CookieStore
+	totp        *totpStore
+	webauthn    *webauthnStore
+	geoDB       *geoDB
+	ipSets      map[string]*ipList
+	ipFiles     map[string]*ipList
+	ruleGroups  map[string]bool
+	ssoHubURL   *url.URL
+	ssoCodec    *securecookie.SecureCookie
 }
 
+// Values for the stateless option.
+const (
+	statelessNever  = `never`
+	statelessAuto   = `auto`
+	statelessAlways = `always`
+)
+
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
@@ -50,6 +165,27 @@ func CreateConfig() *Config {
 		CookieSecure:   false,
 		CookieHttpOnly: false,
 		Realm:          `Restricted`,
+		SSOTicketTTL:   30,
+		LDAPTimeout:    5,
+
+		RadiusTimeout:       3,
+		RadiusNASIdentifier: `trauth`,
+
+		EmailLinkTTL: 600,
+
+		JWTJWKSRefresh:   3600,
+		JWTUsernameClaim: `sub`,
+		JWTGroupsClaim:   `groups`,
+
+		IdentityIssuer: `trauth`,
+		IdentityHeader: `X-Trauth-Identity`,
+		IdentityTTL:    60,
+
+		Stateless:          statelessNever,
+		CredentialCacheTTL: 60,
+
+		SessionIPv4Prefix: 24,
+		SessionIPv6Prefix: 64,
 	}
 }
 
@@ -60,7 +196,8 @@ func CreateConfig() *Config {
 //  2. Prepare user credentials / certificates for auth.
 //
 // There are two types of credentials you case set. Certificates
-// or credentials in htpasswd format.
+// or credentials in htpasswd format. Passwords may also be checked
+// against an LDAP directory or RADIUS servers.
 //
 // For htpasswd, if Users is set a buffered reader is
 // configured to parse that information. If UsersFile is set,
@@ -73,6 +210,12 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("a cookie domain has not been configured")
 	}
 
+	// login links are signed with the cookie key, a random one would
+	// make them fail on other instances and after a reload
+	if len(c.EmailAllow) > 0 && len(c.CookieKey) != 32 {
+		return fmt.Errorf("a 32 character cookiekey is required with emailallow")
+	}
+
 	// cookiestore setup
 	if c.CookieKey == "" || len(c.CookieKey) != 32 {
 		c.CookieKey = string(securecookie.GenerateRandomKey(32))
@@ -87,28 +230,124 @@ func (c *Config) Validate() error {
 		Secure:   c.CookieSecure,
 	}
 
+	switch c.Stateless {
+	case "":
+		c.Stateless = statelessNever
+	case statelessNever, statelessAuto, statelessAlways:
+	default:
+		return fmt.Errorf("stateless must be one of %s, %s or %s", statelessNever, statelessAuto, statelessAlways)
+	}
+
+	if c.SessionIPv4Prefix < 0 || c.SessionIPv4Prefix > 32 {
+		return fmt.Errorf("sessionipv4prefix must be between 0 and 32")
+	}
+
+	if c.SessionIPv6Prefix < 0 || c.SessionIPv6Prefix > 128 {
+		return fmt.Errorf("sessionipv6prefix must be between 0 and 128")
+	}
+
+	// sso setup. tickets are signed with a key shared between the hub
+	// and all of the domains it issues tickets for.
+	if c.ssoEnabled() {
+		if len(c.SSOKey) < 32 {
+			return fmt.Errorf("an ssokey of at least 32 characters is required when sso is configured")
+		}
+
+		if c.SSOTicketTTL <= 0 {
+			return fmt.Errorf("ssotickettl must be a positive number of seconds")
+		}
+
+		c.ssoCodec = securecookie.New([]byte(c.SSOKey), nil).
+			MaxAge(c.SSOTicketTTL).
+			SetSerializer(securecookie.JSONEncoder{})
+	}
+
+	if c.SSOHub != "" {
+		hub, err := url.Parse(c.SSOHub)
+		if err != nil || (hub.Scheme != "http" && hub.Scheme != "https") || hub.Host == "" {
+			return fmt.Errorf("ssohub '%s' must be an absolute http(s) url", c.SSOHub)
+		}
+
+		c.ssoHubURL = hub
+	}
+
+	// geoip databases
+	var geoPaths []string
+	for _, path := range []string{c.GeoIPDB, c.GeoIPASNDB} {
+		if path != "" {
+			geoPaths = append(geoPaths, path)
+		}
+	}
+
+	if len(geoPaths) > 0 {
+		db, err := newGeoDB(geoPaths...)
+		if err != nil {
+			return fmt.Errorf("failed to open geoip database with error: %s", err)
+		}
+
+		c.geoDB = db
+	}
+
+	// named ip sets, shared by all the rules that refer to them
+	c.ipSets = make(map[string]*ipList)
+	c.ipFiles = make(map[string]*ipList)
+	for _, set := range c.IPSets {
+		if set.Name == "" {
+			return fmt.Errorf("an ipset without a name is configured")
+		}
+
+		if _, ok := c.ipSets[set.Name]; ok {
+			return fmt.Errorf("ipset '%s' is configured more than once", set.Name)
+		}
+
+		list, err := newIPList(set.CIDRs, set.File)
+		if err != nil {
+			return fmt.Errorf("failed to load ipset '%s' with error: %s", set.Name, err)
+		}
+
+		c.ipSets[set.Name] = list
+	}
+
 	// process rules by compiling the provided regular expressions
-	// and parsing Excluded IPNets
+	// and parsing Excluded IPNets and other conditions
+	c.ruleGroups = make(map[string]bool)
 	for ridx, rule := range c.Rules {
-		for sidx, exclude := range rule.Excludes {
-			if exclude.IPNet != "" {
-				_, subnet, err := net.ParseCIDR(exclude.IPNet)
-				if err != nil {
-					return fmt.Errorf("failed to parse source ip range '%s' for domain %s with error %s",
-						exclude.IPNet, rule.Domain, err)
-				}
-
-				c.Rules[ridx].Excludes[sidx].ipNet = subnet
+		c.Rules[ridx].index = ridx
+
+		for _, g := range rule.Groups {
+			c.ruleGroups[g] = true
+		}
+
+		for _, w := range rule.Windows {
+			for _, g := range w.Groups {
+				c.ruleGroups[g] = true
+			}
+		}
+
+		if err := c.Rules[ridx].compileHost(); err != nil {
+			return err
+		}
+
+		if err := c.Rules[ridx].compileAction(); err != nil {
+			return err
+		}
+
+		if err := c.Rules[ridx].compileWindows(); err != nil {
+			return err
+		}
+
+		for sidx := range rule.Excludes {
+			exclude := &c.Rules[ridx].Excludes[sidx]
+			if err := exclude.compile(rule.Domain); err != nil {
+				return err
 			}
 
-			if exclude.Path != "" {
-				rex, err := regexp.Compile(exclude.Path)
-				if err != nil {
-					return fmt.Errorf("failed to compile rule regex '%s' for domain %s", exclude.Path, rule.Domain)
-				}
+			if err := c.resolveIPLists(exclude, rule.Domain); err != nil {
+				return err
+			}
 
-				// assign the compiled regex to the struct
-				c.Rules[ridx].Excludes[sidx].regexPath = rex
+			if (len(exclude.Countries) > 0 || len(exclude.ASNs) > 0) && c.geoDB == nil {
+				return fmt.Errorf("country or asn conditions for domain %s need a geoipdb", rule.Domain)
 			}
 		}
 	}
@@ -126,6 +365,129 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	// totp secrets
+	if c.TOTPFile != "" {
+		store, err := newTOTPStore(c.TOTPFile)
+		if err != nil {
+			return fmt.Errorf("failed to read totp secrets with error: %s", err)
+		}
+
+		c.totp = store
+	}
+
+	if c.TOTPRequired && c.totp == nil {
+		return fmt.Errorf("totprequired is set without a totpfile")
+	}
+
+	// passkey store
+	if c.WebAuthnFile != "" {
+		store, err := newWebAuthnStore(c.WebAuthnFile)
+		if err != nil {
+			return fmt.Errorf("failed to read webauthn credentials with error: %s", err)
+		}
+
+		c.webauthn = store
+
+		if c.WebAuthnRPID == "" {
+			c.WebAuthnRPID = c.Domain
+		}
+
+		c.WebAuthnRPID = strings.ToLower(strings.TrimPrefix(c.WebAuthnRPID, "."))
+	}
+
+	// ldap directory
+	if c.LDAPURL != "" {
+		directory, err := newLDAPDirectory(c)
+		if err != nil {
+			return fmt.Errorf("failed to configure ldap for '%s' with error: %s", c.Domain, err)
+		}
+
+		c.ldap = directory
+	}
+
+	// radius servers
+	if len(c.RadiusServers) > 0 {
+		client, err := newRADIUSClient(c)
+		if err != nil {
+			return fmt.Errorf("failed to configure radius for '%s' with error: %s", c.Domain, err)
+		}
+
+		c.radius = client
+	}
+
+	// email login links
+	if len(c.EmailAllow) > 0 {
+		login, err := newEmailLogin(c)
+		if err != nil {
+			return fmt.Errorf("failed to configure email login for '%s' with error: %s", c.Domain, err)
+		}
+
+		c.email = login
+	}
+
+	// api tokens
+	if len(c.Tokens) > 0 || c.TokensFile != "" {
+		store, err := newTokenStore(c.Tokens, c.TokensFile)
+		if err != nil {
+			return fmt.Errorf("failed to read api tokens with error: %s", err)
+		}
+
+		c.tokens = store
+	}
+
+	// jwt verification keys
+	sources := 0
+	for _, source := range []string{c.JWTKeyFile, c.JWTJWKSFile, c.JWTJWKSURL} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return fmt.Errorf("only one of jwtkeyfile, jwtjwksfile and jwtjwksurl may be set for '%s'", c.Domain)
+	}
+
+	// the keys of an identity provider also sign tokens it issues to
+	// other services, the audience is what tells them apart
+	if c.JWTJWKSURL != "" && c.JWTAudience == "" {
+		return fmt.Errorf("jwtaudience is required with jwtjwksurl for '%s'", c.Domain)
+	}
+
+	if sources == 1 {
+		keys, err := newJWTKeySet(c)
+		if err != nil {
+			return fmt.Errorf("failed to read jwt keys with error: %s", err)
+		}
+
+		c.jwtKeys = keys
+	}
+
+	// trusted proxies
+	if err := c.compileTrustedProxies(); err != nil {
+		return err
+	}
+
+	// identity tokens for upstreams
+	if c.IdentityKeyFile != "" {
+		signer, err := newIdentitySigner(c.IdentityKeyFile, c.IdentityAlgorithm)
+		if err != nil {
+			return fmt.Errorf("failed to read identitykeyfile with error: %s", err)
+		}
+
+		if c.IdentityHeader == "" || c.IdentityTTL <= 0 {
+			return fmt.Errorf("identityheader and identityttl are required with identitykeyfile")
+		}
+
+		c.identity = signer
+
+		audiences := make(map[string]string, len(c.IdentityAudiences))
+		for host, aud := range c.IdentityAudiences {
+			audiences[strings.ToLower(host)] = aud
+		}
+
+		c.IdentityAudiences = audiences
+	}
+
 	// htpasswd setup
 	if c.Users != "" && c.UsersFile != "" {
 		return fmt.Errorf("both users and usersfile are set for '%s'", c.Domain)
@@ -156,3 +518,39 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// resolveIPLists links an exclude to the ip set and ip file it refers to.
+// files used by more than one exclude are only loaded once.
+func (c *Config) resolveIPLists(exclude *Exclude, domain string) error {
+
+	if exclude.IPSet != "" {
+		list, ok := c.ipSets[exclude.IPSet]
+		if !ok {
+			return fmt.Errorf("unknown ipset '%s' for domain %s", exclude.IPSet, domain)
+		}
+
+		exclude.setList = list
+	}
+
+	if exclude.IPNetFile != "" {
+		list, ok := c.ipFiles[exclude.IPNetFile]
+		if !ok {
+			var err error
+			if list, err = newIPList(nil, exclude.IPNetFile); err != nil {
+				return fmt.Errorf("failed to load ipnetfile for domain %s with error: %s", domain, err)
+			}
+
+			c.ipFiles[exclude.IPNetFile] = list
+		}
+
+		exclude.fileList = list
+	}
+
+	return nil
+}
+
+// hasPasswords returns true if there is anything to check passwords
+// against, htpasswd users, an ldap directory or radius servers.
+func (c *Config) hasPasswords() bool {
+	return c.htpasswd != nil || c.ldap != nil || c.radius != nil
+}
@@ -0,0 +1,102 @@
+package trauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// credentialCacheSize caps the number of verified credentials kept.
+const credentialCacheSize = 1024
+
+// credentialCache remembers recently verified credentials so that
+// expensive password hashes do not have to be computed, or a directory
+// asked, for every request a stateless client makes.
+type credentialCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	secret  []byte
+	entries map[[sha256.Size]byte]credentialEntry
+}
+
+// credentialEntry is a verified credential, along with the groups its
+// user was found to be a member of.
+type credentialEntry struct {
+	expires time.Time
+	groups  []string
+}
+
+func newCredentialCache(ttl time.Duration) *credentialCache {
+	return &credentialCache{
+		ttl:     ttl,
+		secret:  securecookie.GenerateRandomKey(32),
+		entries: make(map[[sha256.Size]byte]credentialEntry),
+	}
+}
+
+// key derives the cache key for a username and password. the password
+// itself is never stored, and the keys are keyed with a secret of this
+// process so that they can not be used to guess passwords offline.
+func (cc *credentialCache) key(user, pass string) [sha256.Size]byte {
+	var key [sha256.Size]byte
+
+	mac := hmac.New(sha256.New, cc.secret)
+	mac.Write([]byte(user + "\x00" + pass))
+	copy(key[:], mac.Sum(nil))
+
+	return key
+}
+
+// valid returns true if the credentials were verified recently, along
+// with the groups of the user.
+func (cc *credentialCache) valid(user, pass string) ([]string, bool) {
+	if cc.ttl <= 0 {
+		return nil, false
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := cc.key(user, pass)
+	entry, ok := cc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(cc.entries, key)
+		return nil, false
+	}
+
+	return entry.groups, true
+}
+
+// add records credentials as verified.
+func (cc *credentialCache) add(user, pass string, groups []string) {
+	if cc.ttl <= 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now()
+
+	if len(cc.entries) >= credentialCacheSize {
+		for k, entry := range cc.entries {
+			if now.After(entry.expires) {
+				delete(cc.entries, k)
+			}
+		}
+
+		// still full, start over rather than grow without bounds
+		if len(cc.entries) >= credentialCacheSize {
+			cc.entries = make(map[[sha256.Size]byte]credentialEntry)
+		}
+	}
+
+	cc.entries[cc.key(user, pass)] = credentialEntry{expires: now.Add(cc.ttl), groups: groups}
+}
@@ -0,0 +1,365 @@
+package trauth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	loginEmailPath = reservedPath + `login/email`
+
+	emailLinkName = `trauth-email-link`
+
+	// emailResendInterval is how long to wait before sending another
+	// link to the same address.
+	emailResendInterval = time.Minute
+
+	smtpTimeout = 10 * time.Second
+)
+
+// emailLink is the signed value in a login link.
+type emailLink struct {
+	Email string `json:"e"`
+	Host  string `json:"h"`
+	Nonce string `json:"n"`
+}
+
+// emailLogin sends login links to allowed addresses over smtp.
+type emailLogin struct {
+	addresses map[string]bool
+	domains   map[string]bool
+	ttl       time.Duration
+	codec     *securecookie.SecureCookie
+	sent      *ticketCache
+
+	host     string
+	username string
+	password string
+	from     *mail.Address
+}
+
+func newEmailLogin(c *Config) (*emailLogin, error) {
+
+	if c.SMTPHost == "" || c.SMTPFrom == "" {
+		return nil, fmt.Errorf("smtphost and smtpfrom are required with emailallow")
+	}
+
+	if _, _, err := net.SplitHostPort(c.SMTPHost); err != nil {
+		return nil, fmt.Errorf("smtphost '%s' must be a host:port", c.SMTPHost)
+	}
+
+	from, err := mail.ParseAddress(c.SMTPFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtpfrom '%s' with error: %s", c.SMTPFrom, err)
+	}
+
+	if c.EmailLinkTTL <= 0 {
+		return nil, fmt.Errorf("emaillinkttl must be a positive number of seconds")
+	}
+
+	e := &emailLogin{
+		addresses: make(map[string]bool),
+		domains:   make(map[string]bool),
+		ttl:       time.Duration(c.EmailLinkTTL) * time.Second,
+		sent:      newTicketCache(),
+		host:      c.SMTPHost,
+		username:  c.SMTPUsername,
+		password:  c.SMTPPassword,
+		from:      from,
+	}
+
+	// links are signed with the cookie key, the name keeps them apart
+	// from session cookies
+	e.codec = securecookie.New([]byte(c.CookieKey), nil).
+		MaxAge(c.EmailLinkTTL).
+		SetSerializer(securecookie.JSONEncoder{})
+
+	for _, entry := range c.EmailAllow {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if domain := strings.TrimPrefix(entry, "@"); domain != entry && domain != "" {
+			e.domains[domain] = true
+			continue
+		}
+
+		address, ok := parseEmailAddress(entry)
+		if !ok {
+			return nil, fmt.Errorf("invalid emailallow entry '%s'", entry)
+		}
+
+		e.addresses[address] = true
+	}
+
+	return e, nil
+}
+
+// parseEmailAddress validates a bare email address as typed by a user,
+// returning it in lower case.
+func parseEmailAddress(input string) (string, bool) {
+
+	input = strings.TrimSpace(input)
+
+	address, err := mail.ParseAddress(input)
+	if err != nil || address.Name != "" || !strings.EqualFold(address.Address, input) {
+		return "", false
+	}
+
+	return strings.ToLower(address.Address), true
+}
+
+// allowed checks if an address is listed, or is in a listed domain.
+func (e *emailLogin) allowed(address string) bool {
+
+	if e.addresses[address] {
+		return true
+	}
+
+	at := strings.LastIndex(address, "@")
+
+	return at != -1 && e.domains[address[at+1:]]
+}
+
+// send delivers a message to a single recipient, using STARTTLS when the
+// server offers it.
+func (e *emailLogin) send(to, subject, body string) error {
+
+	conn, err := net.DialTimeout("tcp", e.host, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(e.host)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	// plain auth refuses to send credentials without tls, except to localhost
+	if e.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(e.from.Address); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@trauth>\r\n", hex.EncodeToString(securecookie.GenerateRandomKey(16)))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// serveEmailLogin sends login links, and exchanges them for a session.
+//
+// Following a link only shows a button to continue, as mail scanners
+// that fetch links would otherwise use them up.
+func (t *Trauth) serveEmailLogin(rw http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		t.renderLogin(rw, req, http.StatusOK, loginPageData{
+			Redirect:   localRedirect(req.URL.Query().Get("rd")),
+			EmailToken: req.URL.Query().Get("token"),
+		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, 64<<10)
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if !t.validCSRF(req) {
+		t.logger.Printf("refusing email login form without a valid csrf token from %s", req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusForbidden, loginPageData{
+			Redirect: localRedirect(req.PostFormValue("rd")),
+			Error:    "The form expired, try again.",
+		})
+		return
+	}
+
+	if token := req.PostFormValue("token"); token != "" {
+		t.redeemEmailLink(rw, req, token)
+		return
+	}
+
+	t.sendEmailLink(rw, req)
+}
+
+// sendEmailLink emails a login link to the address posted, if it is
+// allowed. The same page is shown either way, so that it does not
+// reveal which addresses are.
+func (t *Trauth) sendEmailLink(rw http.ResponseWriter, req *http.Request) {
+
+	rd := localRedirect(req.PostFormValue("rd"))
+
+	// the resend interval is per address, this keeps a client from
+	// having links sent to every address of an allowed domain
+	if t.loginLimited(rw, req, rd) {
+		return
+	}
+
+	address, ok := parseEmailAddress(req.PostFormValue("email"))
+	if !ok {
+		t.renderLogin(rw, req, http.StatusBadRequest, loginPageData{Redirect: rd, Error: "Enter a valid email address."})
+		return
+	}
+
+	sent := loginPageData{Redirect: rd, EmailSent: true}
+
+	if !t.config.email.allowed(address) {
+		t.logger.Printf("refusing email login link for %s from %s", address, req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusOK, sent)
+		return
+	}
+
+	if !t.config.email.sent.redeem(address, emailResendInterval) {
+		t.logger.Printf("not sending another email login link to %s so soon", address)
+		t.renderLogin(rw, req, http.StatusOK, sent)
+		return
+	}
+
+	token, err := t.config.email.codec.Encode(emailLinkName, emailLink{
+		Email: address,
+		Host:  strings.ToLower(stripPort(req.Host)),
+		Nonce: hex.EncodeToString(securecookie.GenerateRandomKey(16)),
+	})
+	if err != nil {
+		t.logger.Printf("failed to sign email login link with: %s", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	link := url.URL{
+		Scheme:   requestScheme(req),
+		Host:     req.Host,
+		Path:     loginEmailPath,
+		RawQuery: url.Values{"token": {token}, "rd": {rd}}.Encode(),
+	}
+
+	validity := fmt.Sprintf("%d seconds", int(t.config.email.ttl.Seconds()))
+	if t.config.email.ttl%time.Minute == 0 {
+		validity = fmt.Sprintf("%d minutes", int(t.config.email.ttl.Minutes()))
+	}
+
+	subject := fmt.Sprintf("Sign in to %s", t.config.Realm)
+	body := fmt.Sprintf("Follow this link to sign in to %s:\r\n\r\n%s\r\n\r\n"+
+		"The link can be used once, within %s. If you did not ask for it, you can ignore this email.\r\n",
+		t.config.Realm, link.String(), validity)
+
+	remote := req.RemoteAddr
+
+	// sending happens in the background so that the response time does
+	// not give away whether the address was allowed either
+	go func() {
+		if err := t.config.email.send(address, subject, body); err != nil {
+			t.logger.Printf("failed to send email login link to %s with error: %s", address, err)
+			return
+		}
+
+		t.logger.Printf("sent email login link to %s for %s", address, remote)
+	}()
+
+	t.renderLogin(rw, req, http.StatusOK, sent)
+}
+
+// redeemEmailLink exchanges the token from a login link for a session.
+func (t *Trauth) redeemEmailLink(rw http.ResponseWriter, req *http.Request, token string) {
+
+	rd := localRedirect(req.PostFormValue("rd"))
+	invalid := loginPageData{Redirect: rd, Error: "This link is invalid or has expired."}
+
+	var link emailLink
+	if err := t.config.email.codec.Decode(emailLinkName, token, &link); err != nil {
+		t.logger.Printf("invalid email login link from %s: %s", req.RemoteAddr, err)
+		t.renderLogin(rw, req, http.StatusUnauthorized, invalid)
+		return
+	}
+
+	if link.Host != strings.ToLower(stripPort(req.Host)) || !t.config.email.allowed(link.Email) {
+		t.logger.Printf("email login link for %s on %s presented to %s from %s",
+			link.Email, link.Host, req.Host, req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusUnauthorized, invalid)
+		return
+	}
+
+	if !t.tickets.redeem(link.Nonce, t.config.email.ttl) {
+		t.logger.Printf("replayed email login link for %s from %s", link.Email, req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusUnauthorized, invalid)
+		return
+	}
+
+	if _, err := setUser(t.config, link.Email, authMethodEmail, nil, rw, req); err != nil {
+		t.sessionFailed(rw, err)
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using an email login link", link.Email, req.RemoteAddr)
+	http.Redirect(rw, req, rd, http.StatusSeeOther)
+}
@@ -0,0 +1,280 @@
+package trauth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpTestMessage is a message received by the test sink.
+type smtpTestMessage struct {
+	to   string
+	body string
+}
+
+// newSMTPTestSink starts a minimal SMTP server that accepts every
+// message and passes it on to the returned channel.
+func newSMTPTestSink(t *testing.T) (string, <-chan smtpTestMessage) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	messages := make(chan smtpTestMessage, 10)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go smtpTestSession(conn, messages)
+		}
+	}()
+
+	return l.Addr().String(), messages
+}
+
+func smtpTestSession(conn net.Conn, messages chan<- smtpTestMessage) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+
+	reply("220 sink ESMTP")
+
+	var msg smtpTestMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				if l == ".\r\n" {
+					break
+				}
+
+				data.WriteString(l)
+			}
+
+			msg.body = data.String()
+			messages <- msg
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// receiveLink waits for a message and returns the login link in it.
+func receiveLink(t *testing.T, messages <-chan smtpTestMessage, to string) *url.URL {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		if msg.to != to {
+			t.Fatalf("link sent to %q, want %q", msg.to, to)
+		}
+
+		_, body, _ := strings.Cut(msg.body, "\r\n\r\n")
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range strings.Split(string(decoded), "\r\n") {
+			if strings.HasPrefix(line, "http") {
+				link, err := url.Parse(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return link
+			}
+		}
+
+		t.Fatalf("no link in message %q", decoded)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no link was sent to %s", to)
+	}
+
+	return nil
+}
+
+// expectNoMessage checks that nothing is sent for a short while.
+func expectNoMessage(t *testing.T, messages <-chan smtpTestMessage) {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		t.Errorf("unexpected message to %s", msg.to)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func newEmailTestTrauth(t *testing.T) (*Trauth, <-chan smtpTestMessage) {
+	t.Helper()
+
+	addr, messages := newSMTPTestSink(t)
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.EmailAllow = []string{"alice@example.com", "@corp.example"}
+	c.CookieKey = "1f5a7e4b9c2d8e3f6a0b1c2d3e4f5a6b"
+	c.SMTPHost = addr
+	c.SMTPFrom = "trauth@example.com"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handler.(*Trauth), messages
+}
+
+// postEmailForm posts the email login form on a host, with the csrf
+// token of its login page.
+func postEmailForm(t *testing.T, tr *Trauth, host string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	page := httptest.NewRecorder()
+	tr.ServeHTTP(page, httptest.NewRequest("GET", "http://"+host+loginPath, nil))
+
+	req := httptest.NewRequest("POST", "http://"+host+loginEmailPath, nil)
+	for _, cookie := range page.Result().Cookies() {
+		req.AddCookie(cookie)
+		if cookie.Name == tr.config.csrfCookieName() {
+			form.Set("csrf", cookie.Value)
+		}
+	}
+
+	req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rw := httptest.NewRecorder()
+	tr.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestEmailAllowList(t *testing.T) {
+	tr, messages := newEmailTestTrauth(t)
+
+	for _, address := range []string{"mallory@example.com", "alice@corp.example.org"} {
+		if rw := postEmailForm(t, tr, "example.com", url.Values{"email": {address}}); rw.Code != http.StatusOK {
+			t.Errorf("%s: responded %d, want %d", address, rw.Code, http.StatusOK)
+		}
+	}
+
+	expectNoMessage(t, messages)
+
+	for _, address := range []string{"alice@example.com", "Bob@Corp.Example"} {
+		postEmailForm(t, tr, "example.com", url.Values{"email": {address}})
+		receiveLink(t, messages, strings.ToLower(address))
+	}
+}
+
+func TestEmailResendThrottle(t *testing.T) {
+	tr, messages := newEmailTestTrauth(t)
+
+	postEmailForm(t, tr, "example.com", url.Values{"email": {"alice@example.com"}})
+	receiveLink(t, messages, "alice@example.com")
+
+	postEmailForm(t, tr, "example.com", url.Values{"email": {"alice@example.com"}})
+	expectNoMessage(t, messages)
+}
+
+func TestEmailLinkHostAndSingleUse(t *testing.T) {
+	tr, messages := newEmailTestTrauth(t)
+
+	postEmailForm(t, tr, "app.example.com", url.Values{"email": {"alice@example.com"}, "rd": {"/docs"}})
+	link := receiveLink(t, messages, "alice@example.com")
+
+	if link.Host != "app.example.com" || link.Path != loginEmailPath {
+		t.Fatalf("link %s is not for the host it was requested on", link)
+	}
+
+	redeem := url.Values{"token": {link.Query().Get("token")}, "rd": {link.Query().Get("rd")}}
+
+	if rw := postEmailForm(t, tr, "other.example.com", redeem); rw.Code != http.StatusUnauthorized {
+		t.Errorf("link on another host responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	rw := postEmailForm(t, tr, "app.example.com", redeem)
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/docs" {
+		t.Fatalf("link responded %d to %q, want a redirect to /docs", rw.Code, rw.Header().Get("Location"))
+	}
+
+	if len(rw.Result().Cookies()) == 0 {
+		t.Errorf("no session cookie was set")
+	}
+
+	if rw := postEmailForm(t, tr, "app.example.com", redeem); rw.Code != http.StatusUnauthorized {
+		t.Errorf("reused link responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestEmailClientRateLimit(t *testing.T) {
+	tr, messages := newEmailTestTrauth(t)
+
+	// a client cycling through addresses gets around the resend interval
+	for i := 0; i < loginAttempts; i++ {
+		address := fmt.Sprintf("user%d@example.org", i)
+		if rw := postEmailForm(t, tr, "example.com", url.Values{"email": {address}}); rw.Code != http.StatusOK {
+			t.Fatalf("%s: responded %d, want %d", address, rw.Code, http.StatusOK)
+		}
+	}
+
+	rw := postEmailForm(t, tr, "example.com", url.Values{"email": {"alice@example.com"}})
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Fatalf("responded %d with Retry-After %q, want %d", rw.Code, rw.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	expectNoMessage(t, messages)
+}
+
+func TestEmailRequiresCookieKey(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.EmailAllow = []string{"alice@example.com"}
+	c.SMTPHost = "localhost:25"
+	c.SMTPFrom = "trauth@example.com"
+
+	if err := c.Validate(); err == nil {
+		t.Errorf("emailallow was accepted without a cookiekey")
+	}
+}
@@ -0,0 +1,113 @@
+package trauth
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// geoLocation is what trauth knows about where an address is from.
+type geoLocation struct {
+	Country string
+	ASN     uint
+}
+
+// geoDB looks up locations in one or more MaxMind DB files, reloading
+// them when they change on disk.
+type geoDB struct {
+	mu      sync.RWMutex
+	readers []*mmdbReader
+	files   []*watchedFile
+	logger  *log.Logger
+}
+
+// newGeoDB opens the given MaxMind DB files. Country (or city) and ASN
+// databases may be combined, their results are merged.
+func newGeoDB(paths ...string) (*geoDB, error) {
+
+	db := &geoDB{logger: NewLogger()}
+
+	for _, path := range paths {
+		reader, err := openMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+
+		db.readers = append(db.readers, reader)
+		db.files = append(db.files, newWatchedFile(path))
+	}
+
+	return db, nil
+}
+
+// reload re-reads any database that changed on disk. A database that
+// fails to load is logged and the previous version kept.
+func (db *geoDB) reload() {
+	for idx, file := range db.files {
+		if !file.changed() {
+			continue
+		}
+
+		reader, err := openMMDB(file.path)
+		if err != nil {
+			db.logger.Printf("failed to reload geoip database %s, keeping the previous one: %s", file.path, err)
+			continue
+		}
+
+		db.mu.Lock()
+		db.readers[idx] = reader
+		db.mu.Unlock()
+
+		db.logger.Printf("reloaded geoip database %s", file.path)
+	}
+}
+
+// lookup returns the location of an address. Unknown values are left empty.
+func (db *geoDB) lookup(ip net.IP) geoLocation {
+
+	var loc geoLocation
+
+	if db == nil || ip == nil {
+		return loc
+	}
+
+	db.reload()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, reader := range db.readers {
+		record, err := reader.lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+
+		if loc.Country == "" {
+			loc.Country = countryCode(record)
+		}
+
+		if loc.ASN == 0 {
+			loc.ASN, _ = toUint(record["autonomous_system_number"])
+		}
+	}
+
+	return loc
+}
+
+// countryCode reads the country iso code from a country or city record,
+// falling back to the registered country for anonymous networks.
+func countryCode(record map[string]interface{}) string {
+	for _, key := range []string{"country", "registered_country"} {
+		country, ok := record[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if code, ok := country["iso_code"].(string); ok && code != "" {
+			return strings.ToUpper(code)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,205 @@
+package trauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const jwksPath = reservedPath + `jwks.json`
+
+// identitySigner mints the jwts that tell upstream services who a
+// request was authenticated as.
+type identitySigner struct {
+	alg string
+	kid string
+	key crypto.Signer
+	jwk jwk
+}
+
+// readPEMPrivateKey reads a pkcs8, pkcs1 or sec1 encoded private key.
+func readPEMPrivateKey(path string) (crypto.Signer, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data found in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+func newIdentitySigner(path, alg string) (*identitySigner, error) {
+
+	key, err := readPEMPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &identitySigner{key: key}
+
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		s.alg = jwtRS256
+		s.jwk = jwk{Kty: "RSA", N: b64url.EncodeToString(pub.N.Bytes()),
+			E: b64url.EncodeToString(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only p-256 ec keys are supported")
+		}
+
+		s.alg = jwtES256
+		s.jwk = jwk{Kty: "EC", Crv: "P-256",
+			X: b64url.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y: b64url.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		s.alg = jwtEdDSA
+		s.jwk = jwk{Kty: "OKP", Crv: "Ed25519", X: b64url.EncodeToString(pub)}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	if alg != "" && alg != s.alg {
+		return nil, fmt.Errorf("a %s key can not be used for %s", s.alg, alg)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+	s.kid = b64url.EncodeToString(sum[:16])
+
+	s.jwk.Kid, s.jwk.Use, s.jwk.Alg = s.kid, "sig", s.alg
+
+	return s, nil
+}
+
+// sign creates a compact jws of the given claims.
+func (s *identitySigner) sign(claims map[string]interface{}) (string, error) {
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := b64url.EncodeToString(header) + "." + b64url.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		// jws uses the raw r || s encoding, not asn.1
+		var r, ss *big.Int
+		if r, ss, err = ecdsa.Sign(rand.Reader, key, digest[:]); err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	default:
+		err = fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + b64url.EncodeToString(sig), nil
+}
+
+// identityAudience returns the audience of identity tokens for a host,
+// which is the host itself unless configured otherwise.
+func (c *Config) identityAudience(host string) string {
+
+	host = strings.ToLower(stripPort(host))
+	if aud, ok := c.IdentityAudiences[host]; ok {
+		return aud
+	}
+
+	return host
+}
+
+// setIdentityToken attaches a signed identity token for a user to a
+// request that is about to be forwarded.
+func (t *Trauth) setIdentityToken(user User, req *http.Request) error {
+
+	now := time.Now()
+
+	claims := map[string]interface{}{
+		"iss": t.config.IdentityIssuer,
+		"aud": t.config.identityAudience(req.Host),
+		"sub": user.Username,
+		"amr": strings.Split(user.Method, "+"),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Duration(t.config.IdentityTTL) * time.Second).Unix(),
+	}
+
+	if len(user.Groups) > 0 {
+		claims["groups"] = user.Groups
+	}
+
+	if !user.IssuedAt.IsZero() {
+		claims["auth_time"] = user.IssuedAt.Unix()
+	}
+
+	token, err := t.config.identity.sign(claims)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(t.config.IdentityHeader, token)
+
+	return nil
+}
+
+// serveJWKS publishes the public key identity tokens are signed with.
+func (t *Trauth) serveJWKS(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/jwk-set+json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(rw).Encode(jwks{Keys: []jwk{t.config.identity.jwk}})
+}
@@ -0,0 +1,153 @@
+package trauth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM writes a pem block to a file in a temporary directory.
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestIdentityTokenRoundTrip(t *testing.T) {
+	keys := newJWTTestKeys(t)
+
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return der
+	}
+
+	ecDER, err := x509.MarshalECPrivateKey(keys.ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		alg  string
+	}{
+		{"pkcs1 rsa", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa)), jwtRS256},
+		{"pkcs8 rsa", writePEM(t, "PRIVATE KEY", pkcs8(keys.rsa)), jwtRS256},
+		{"sec1 ec", writePEM(t, "EC PRIVATE KEY", ecDER), jwtES256},
+		{"pkcs8 ec", writePEM(t, "PRIVATE KEY", pkcs8(keys.ec)), jwtES256},
+		{"pkcs8 ed25519", writePEM(t, "PRIVATE KEY", pkcs8(keys.ed)), jwtEdDSA},
+	}
+
+	for _, test := range tests {
+		c := CreateConfig()
+		c.Domain = "example.com"
+		c.IdentityKeyFile = test.path
+		c.IdentityIssuer = "https://auth.example.com"
+		c.IdentityAudiences = map[string]string{"API.example.com": "internal-api"}
+		c.Tokens = []APIToken{{Name: "ci", Hash: tokenTestHash("ci-token"), Groups: []string{"deploy"}}}
+
+		var identity string
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { identity = req.Header.Get(c.IdentityHeader) })
+		handler, err := New(context.Background(), next, c, "test")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		// the public key is published on every host
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "http://app.example.com"+jwksPath, nil))
+		jwks, _ := io.ReadAll(rw.Body)
+
+		jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+		if err := os.WriteFile(jwksFile, jwks, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		for host, audience := range map[string]string{"app.example.com": "app.example.com", "api.example.com:8443": "internal-api"} {
+			identity = ""
+
+			req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+			req.Header.Set("Authorization", "Bearer ci-token")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if identity == "" {
+				t.Fatalf("%s: no identity token was forwarded to %s", test.name, host)
+			}
+
+			// verify the token the way a service would, with the published keys
+			verifier := CreateConfig()
+			verifier.Domain = "example.com"
+			verifier.JWTJWKSFile = jwksFile
+			verifier.JWTIssuer = "https://auth.example.com"
+			verifier.JWTAudience = audience
+			if err := verifier.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := verifier.verifyJWT(identity)
+			if err != nil {
+				t.Errorf("%s: token for %s did not verify: %s", test.name, host, err)
+				continue
+			}
+
+			groups, amr := claimStrings(claims["groups"]), claimStrings(claims["amr"])
+			if claims["sub"] != "ci" || len(groups) != 1 || groups[0] != "deploy" || len(amr) != 1 || amr[0] != authMethodToken {
+				t.Errorf("%s: token for %s has claims %v", test.name, host, claims)
+			}
+		}
+	}
+}
+
+func TestIdentityAlgorithmMismatch(t *testing.T) {
+	keys := newJWTTestKeys(t)
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.IdentityKeyFile = writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa))
+	c.IdentityAlgorithm = jwtES256
+
+	if err := c.Validate(); err == nil {
+		t.Errorf("an rsa key was accepted for %s", jwtES256)
+	}
+}
+
+func TestIdentityHeaderReplaced(t *testing.T) {
+	keys := newJWTTestKeys(t)
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.IdentityKeyFile = writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa))
+	c.Tokens = []APIToken{{Name: "ci", Hash: tokenTestHash("ci-token")}}
+
+	var identity []string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { identity = req.Header.Values(c.IdentityHeader) })
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client can not send its own token along
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	req.Header.Set(c.IdentityHeader, "forged")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(identity) != 1 || identity[0] == "forged" {
+		t.Errorf("forwarded identity headers %v, want only the signed token", identity)
+	}
+}
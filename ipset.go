@@ -0,0 +1,218 @@
+package trauth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IPSet is a named list of networks that rules can refer to.
+//
+// Networks can be listed inline in CIDRs, read from a File, or both. A
+// file has one network (or address) per line, and blank lines and
+// anything after a # are ignored. Files are reloaded when they change.
+type IPSet struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+	File  string   `yaml:"file"`
+}
+
+// ipRange is an inclusive range of addresses in their 16 byte form.
+type ipRange struct {
+	start, end [16]byte
+}
+
+// ipList is a set of networks with fast lookups, by keeping merged and
+// sorted address ranges that can be binary searched.
+type ipList struct {
+	mu     sync.RWMutex
+	ranges []ipRange
+
+	inline []*net.IPNet
+	file   *watchedFile
+	logger *log.Logger
+}
+
+// parseNetwork parses a network in CIDR notation, or a single address.
+func parseNetwork(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s'", v)
+		}
+
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(v)
+
+	return network, err
+}
+
+// readNetworks parses a file of networks.
+func readNetworks(path string) ([]*net.IPNet, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var networks []*net.IPNet
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		network, err := parseNetwork(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, n, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, scanner.Err()
+}
+
+// toRange converts a network to its first and last address.
+func toRange(network *net.IPNet) ipRange {
+	var r ipRange
+
+	ip := network.IP.To16()
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		// widen the mask to cover the ipv4-mapped ipv6 form
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+
+	for i := 0; i < 16; i++ {
+		r.start[i] = ip[i] & mask[i]
+		r.end[i] = ip[i] | ^mask[i]
+	}
+
+	return r
+}
+
+// buildRanges sorts and merges networks into non overlapping ranges.
+func buildRanges(networks []*net.IPNet) []ipRange {
+
+	ranges := make([]ipRange, 0, len(networks))
+	for _, network := range networks {
+		ranges = append(ranges, toRange(network))
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if bytes.Compare(r.start[:], last.end[:]) <= 0 {
+				if bytes.Compare(r.end[:], last.end[:]) > 0 {
+					last.end = r.end
+				}
+
+				continue
+			}
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// newIPList creates a list from inline networks and an optional file.
+func newIPList(cidrs []string, path string) (*ipList, error) {
+
+	list := &ipList{logger: NewLogger()}
+
+	for _, cidr := range cidrs {
+		network, err := parseNetwork(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+
+		list.inline = append(list.inline, network)
+	}
+
+	networks := list.inline
+	if path != "" {
+		fromFile, err := readNetworks(path)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(append([]*net.IPNet{}, networks...), fromFile...)
+		list.file = newWatchedFile(path)
+	}
+
+	list.ranges = buildRanges(networks)
+
+	return list, nil
+}
+
+// reload re-reads the file of a list if it changed. A file that fails
+// to parse is logged and the previous networks kept.
+func (l *ipList) reload() {
+	if l.file == nil || !l.file.changed() {
+		return
+	}
+
+	fromFile, err := readNetworks(l.file.path)
+	if err != nil {
+		l.logger.Printf("failed to reload ip list %s, keeping the previous one: %s", l.file.path, err)
+		return
+	}
+
+	ranges := buildRanges(append(append([]*net.IPNet{}, l.inline...), fromFile...))
+
+	l.mu.Lock()
+	l.ranges = ranges
+	l.mu.Unlock()
+
+	l.logger.Printf("reloaded ip list %s with %d networks", l.file.path, len(fromFile))
+}
+
+// contains checks if an address is in any of the networks of the list.
+func (l *ipList) contains(ip net.IP) bool {
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+
+	l.reload()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	// find the last range starting at or before the address
+	idx := sort.Search(len(l.ranges), func(i int) bool {
+		return bytes.Compare(l.ranges[i].start[:], ip16) > 0
+	}) - 1
+
+	return idx >= 0 && bytes.Compare(ip16, l.ranges[idx].end[:]) <= 0
+}
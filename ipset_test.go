@@ -0,0 +1,132 @@
+package trauth
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPListContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "networks")
+	content := "# office\n192.168.10.0/24\n\n203.0.113.7 # vpn\n2001:db8::/48\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := newIPList([]string{"10.0.0.0/8", " 10.1.0.0/16 ", "172.16.0.0/13", "172.24.0.0/13"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"10.1.2.3", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		// adjacent networks merged into 172.16.0.0/12
+		{"172.16.0.1", true},
+		{"172.23.255.255", true},
+		{"172.24.0.0", true},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"192.168.10.200", true},
+		{"192.168.11.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:10.2.3.4", true},
+		{"2001:db8::1", true},
+		{"2001:db8:1::1", false},
+		{"::1", false},
+	}
+
+	for _, test := range tests {
+		if got := list.contains(net.ParseIP(test.ip)); got != test.contains {
+			t.Errorf("contains %s = %t, want %t", test.ip, got, test.contains)
+		}
+	}
+}
+
+func TestBuildRangesMerges(t *testing.T) {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.1.0.0/16", "10.0.0.0/8", "10.2.0.0/16", "192.168.0.0/24", "192.168.1.0/24", "192.168.3.0/24"} {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	// the /16s fall inside the /8, and the first two /24s are adjacent
+	// but are not merged as ranges only merge when they overlap
+	if ranges := buildRanges(networks); len(ranges) != 4 {
+		t.Errorf("built %d ranges, want 4", len(ranges))
+	}
+}
+
+func TestIPListInvalid(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not an address", "10.0.0"} {
+		if _, err := newIPList([]string{cidr}, ""); err == nil {
+			t.Errorf("network %q was accepted", cidr)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "networks")
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\nbogus\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newIPList(nil, path); err == nil {
+		t.Errorf("file with an invalid line was accepted")
+	}
+}
+
+func TestIPListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "networks")
+	if err := os.WriteFile(path, []byte("192.168.10.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := newIPList([]string{"10.0.0.0/8"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrite the file with a new modification time, and pretend the
+	// last check was long enough ago
+	rewrite := func(content string, age time.Duration) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		list.file.lastCheck = time.Time{}
+	}
+
+	rewrite("192.168.20.0/24\n", time.Hour)
+
+	if list.contains(net.ParseIP("192.168.10.1")) || !list.contains(net.ParseIP("192.168.20.1")) {
+		t.Errorf("file changes were not picked up")
+	}
+
+	if !list.contains(net.ParseIP("10.1.2.3")) {
+		t.Errorf("inline networks were lost on reload")
+	}
+
+	// a broken file keeps the networks that were loaded before
+	rewrite("bogus\n", time.Minute)
+
+	if !list.contains(net.ParseIP("192.168.20.1")) {
+		t.Errorf("networks were dropped when the file failed to parse")
+	}
+}
@@ -0,0 +1,562 @@
+package trauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported jwt signature algorithms.
+const (
+	jwtRS256 = `RS256`
+	jwtES256 = `ES256`
+	jwtEdDSA = `EdDSA`
+)
+
+const (
+	// jwtLeeway allows for clock drift when checking exp and nbf.
+	jwtLeeway = 60 * time.Second
+	// jwksMinRefresh limits how often a jwks url is fetched when a
+	// token names a key that is not known yet.
+	jwksMinRefresh = time.Minute
+	// jwksMaxSize caps the size of a fetched jwks document.
+	jwksMaxSize = 1 << 20
+)
+
+// jwk is a json web key (RFC 7517), as found in a jwks document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwks is a json web key set.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwtKey is a public key that tokens may be signed with.
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// publicKey decodes a jwk, returning the algorithm it is for.
+func (k jwk) publicKey() (crypto.PublicKey, string, error) {
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64url.DecodeString(k.N)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid rsa modulus")
+		}
+
+		e, err := b64url.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", fmt.Errorf("invalid rsa exponent")
+		}
+
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.E < 3 || pub.N.BitLen() < 2048 {
+			return nil, "", fmt.Errorf("rsa key is too weak")
+		}
+
+		return pub, jwtRS256, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, "", fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, errX := b64url.DecodeString(k.X)
+		y, errY := b64url.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, "", fmt.Errorf("invalid ec point")
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, "", fmt.Errorf("ec point is not on the curve")
+		}
+
+		return pub, jwtES256, nil
+	case "OKP":
+		x, err := b64url.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("unsupported okp key")
+		}
+
+		return ed25519.PublicKey(x), jwtEdDSA, nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// parseJWKS decodes the keys of a jwks document that can verify
+// signatures. keys trauth does not support are skipped.
+func parseJWKS(raw []byte) ([]jwtKey, error) {
+
+	var set jwks
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, alg, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+
+		keys = append(keys, jwtKey{kid: k.Kid, alg: alg, key: pub})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signing keys")
+	}
+
+	return keys, nil
+}
+
+// readPEMPublicKey reads a public key, or the key of a certificate,
+// from a pem file.
+func readPEMPublicKey(path string) (jwtKey, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return jwtKey{}, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return jwtKey{}, fmt.Errorf("no pem data found in %s", path)
+	}
+
+	var pub crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return jwtKey{}, err
+		}
+
+		pub = cert.PublicKey
+	default:
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return jwtKey{}, err
+		}
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return jwtKey{alg: jwtRS256, key: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return jwtKey{}, fmt.Errorf("only p-256 ec keys are supported")
+		}
+
+		return jwtKey{alg: jwtES256, key: k}, nil
+	case ed25519.PublicKey:
+		return jwtKey{alg: jwtEdDSA, key: k}, nil
+	}
+
+	return jwtKey{}, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// jwtKeySet holds the keys jwts are verified with. keys from a file are
+// reloaded when it changes, keys from a url are fetched again every
+// refresh interval, or sooner when a token uses a new key id.
+type jwtKeySet struct {
+	mu      sync.RWMutex
+	keys    []jwtKey
+	file    *watchedFile
+	url     string
+	refresh time.Duration
+	fetched time.Time
+	tried   time.Time
+	client  *http.Client
+	logger  *log.Logger
+}
+
+func newJWTKeySet(c *Config) (*jwtKeySet, error) {
+
+	ks := &jwtKeySet{
+		logger:  NewLogger(),
+		refresh: time.Duration(c.JWTJWKSRefresh) * time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	switch {
+	case c.JWTKeyFile != "":
+		key, err := readPEMPublicKey(c.JWTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		ks.keys = []jwtKey{key}
+	case c.JWTJWKSFile != "":
+		raw, err := os.ReadFile(c.JWTJWKSFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if ks.keys, err = parseJWKS(raw); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.JWTJWKSFile, err)
+		}
+
+		ks.file = newWatchedFile(c.JWTJWKSFile)
+	case c.JWTJWKSURL != "":
+		// the url is fetched on first use, so that a jwks endpoint
+		// that is down does not stop traefik from loading the plugin
+		ks.url = c.JWTJWKSURL
+	}
+
+	return ks, nil
+}
+
+// reload refreshes the keys from their source if needed. unknown is set
+// when a token was signed with a key id that is not in the set.
+func (ks *jwtKeySet) reload(unknown bool) {
+
+	if ks.file != nil && ks.file.changed() {
+		raw, err := os.ReadFile(ks.file.path)
+		if err == nil {
+			var keys []jwtKey
+			if keys, err = parseJWKS(raw); err == nil {
+				ks.mu.Lock()
+				ks.keys = keys
+				ks.mu.Unlock()
+
+				ks.logger.Printf("reloaded %d jwt keys from %s", len(keys), ks.file.path)
+				return
+			}
+		}
+
+		ks.logger.Printf("failed to reload jwks %s, keeping the previous keys: %s", ks.file.path, err)
+	}
+
+	if ks.url == "" {
+		return
+	}
+
+	ks.mu.Lock()
+	now := time.Now()
+	stale := ks.fetched.IsZero() || now.Sub(ks.fetched) > ks.refresh || unknown
+	if !stale || now.Sub(ks.tried) < jwksMinRefresh {
+		ks.mu.Unlock()
+		return
+	}
+
+	ks.tried = now
+	ks.mu.Unlock()
+
+	keys, err := ks.fetch()
+	if err != nil {
+		ks.logger.Printf("failed to fetch jwks from %s: %s", ks.url, err)
+		return
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.fetched = now
+	ks.mu.Unlock()
+}
+
+// fetch downloads the jwks document of the key set url.
+func (ks *jwtKeySet) fetch() ([]jwtKey, error) {
+
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(raw)
+}
+
+// find returns the keys that may have signed a token.
+func (ks *jwtKeySet) find(alg, kid string) []jwtKey {
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	var found []jwtKey
+	for _, k := range ks.keys {
+		if k.alg == alg && (kid == "" || k.kid == "" || k.kid == kid) {
+			found = append(found, k)
+		}
+	}
+
+	return found
+}
+
+// jwtHeader is the protected header of a jws.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// looksLikeJWT checks if a bearer token has the shape of a compact jws,
+// to tell it apart from an api token.
+func looksLikeJWT(value string) bool {
+	return strings.Count(value, ".") == 2
+}
+
+// verifyJWT checks the signature and registered claims of a token,
+// returning its claims.
+func (c *Config) verifyJWT(token string) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	rawHeader, err := b64url.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	sig, err := b64url.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+
+	switch header.Alg {
+	case jwtRS256, jwtES256, jwtEdDSA:
+	default:
+		// notably, this refuses "none" and hmac algorithms
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	c.jwtKeys.reload(false)
+	keys := c.jwtKeys.find(header.Alg, header.Kid)
+	if len(keys) == 0 {
+		c.jwtKeys.reload(true)
+		keys = c.jwtKeys.find(header.Alg, header.Kid)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range keys {
+		if verifyJWS(k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("no key with id %q verifies the signature", header.Kid)
+	}
+
+	rawClaims, err := b64url.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(rawClaims)))
+	decoder.UseNumber()
+
+	var claims map[string]interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+
+	return claims, c.checkJWTClaims(claims)
+}
+
+// verifyJWS checks a jws signature with a key.
+func verifyJWS(k jwtKey, signed, sig []byte) bool {
+
+	switch pub := k.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// jws uses the raw r || s encoding, not asn.1
+		if len(sig) != 64 {
+			return false
+		}
+
+		digest := sha256.Sum256(signed)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, sig)
+	}
+
+	return false
+}
+
+// checkJWTClaims validates the time, issuer and audience claims.
+func (c *Config) checkJWTClaims(claims map[string]interface{}) error {
+
+	now := time.Now()
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return fmt.Errorf("token has no exp claim")
+	}
+
+	if now.After(exp.Add(jwtLeeway)) {
+		return fmt.Errorf("token expired at %s", exp.Format(time.RFC3339))
+	}
+
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return fmt.Errorf("token is not valid before %s", nbf.Format(time.RFC3339))
+	}
+
+	if c.JWTIssuer != "" && claims["iss"] != c.JWTIssuer {
+		return fmt.Errorf("token issuer %v is not %s", claims["iss"], c.JWTIssuer)
+	}
+
+	if c.JWTAudience != "" && !containsClaim(claims["aud"], c.JWTAudience) {
+		return fmt.Errorf("token audience %v does not include %s", claims["aud"], c.JWTAudience)
+	}
+
+	return nil
+}
+
+// numericDate decodes a NumericDate claim.
+func numericDate(v interface{}) (time.Time, bool) {
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(f), 0), true
+}
+
+// containsClaim checks if a string or list of strings claim has a value.
+func containsClaim(v interface{}, want string) bool {
+	for _, s := range claimStrings(v) {
+		if s == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+// claimStrings returns the values of a string or list of strings claim.
+func claimStrings(v interface{}) []string {
+
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var out []string
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+// lookupClaim finds a claim by name, where dots separate the names of
+// nested objects, such as realm_access.roles.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+
+	// a claim with dots in its name wins over a nested one
+	if v, ok := claims[name]; ok {
+		return v
+	}
+
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		v = obj[part]
+	}
+
+	return v
+}
+
+// tryJWTAuth authenticates a request that carries a jwt. like api
+// tokens, no session is created.
+func (t *Trauth) tryJWTAuth(rw http.ResponseWriter, req *http.Request, rule *Rule, token string) {
+
+	claims, err := t.config.verifyJWT(token)
+
+	var username string
+	if err == nil {
+		if username, _ = lookupClaim(claims, t.config.JWTUsernameClaim).(string); username == "" {
+			err = fmt.Errorf("token has no %s claim", t.config.JWTUsernameClaim)
+		}
+	}
+
+	if err != nil {
+		t.logger.Printf("invalid jwt from %s to %s: %s", req.RemoteAddr, req.Host, err)
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, t.config.Realm))
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	user := User{
+		Username:      username,
+		Authenticated: true,
+		Groups:        claimStrings(lookupClaim(claims, t.config.JWTGroupsClaim)),
+		Method:        authMethodJWT,
+	}
+
+	t.debugf("jwt for %s (groups %v) authenticated %s%s", user.Username, user.Groups, req.Host, req.URL.Path)
+	t.forward(rw, req, user, rule)
+}
@@ -0,0 +1,374 @@
+package trauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtTestKeys are the signing keys the tests mint tokens with.
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey, ed: edKey}
+}
+
+// jwks returns the public keys as a jwks document, with the kids rsa,
+// ec and ed.
+func (k *jwtTestKeys) jwks(t *testing.T) []byte {
+	t.Helper()
+
+	ecPoint := func(n *big.Int) string { return b64url.EncodeToString(n.FillBytes(make([]byte, 32))) }
+
+	raw, err := json.Marshal(jwks{Keys: []jwk{
+		{
+			Kty: "RSA", Kid: "rsa", Use: "sig",
+			N: b64url.EncodeToString(k.rsa.N.Bytes()),
+			E: b64url.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes()),
+		},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: ecPoint(k.ec.X), Y: ecPoint(k.ec.Y)},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64url.EncodeToString(k.ed.Public().(ed25519.PublicKey))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+// signJWT mints a compact jws. The key decides how it is signed, the
+// header is used as given.
+func signJWT(t *testing.T, key interface{}, header, claims map[string]interface{}) string {
+	t.Helper()
+
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := b64url.EncodeToString(rawHeader) + "." + b64url.EncodeToString(rawClaims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case nil:
+	default:
+		t.Fatalf("can not sign with %T", key)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64url.EncodeToString(sig)
+}
+
+// validClaims returns claims that pass checkJWTClaims of newJWTTestConfig.
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://idp.example.com",
+		"aud": "internal-api",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// newJWTTestConfig returns a config verifying tokens with a jwks file
+// of the test keys.
+func newJWTTestConfig(t *testing.T, keys *jwtTestKeys) *Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.JWTJWKSFile = path
+	c.JWTIssuer = "https://idp.example.com"
+	c.JWTAudience = "internal-api"
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestVerifyJWTAlgorithms(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	c := newJWTTestConfig(t, keys)
+
+	tests := []struct {
+		alg string
+		kid string
+		key interface{}
+	}{
+		{jwtRS256, "rsa", keys.rsa},
+		{jwtES256, "ec", keys.ec},
+		{jwtEdDSA, "ed", keys.ed},
+		// without a kid, every key for the algorithm is tried
+		{jwtES256, "", keys.ec},
+	}
+
+	for _, test := range tests {
+		header := map[string]interface{}{"alg": test.alg, "typ": "JWT"}
+		if test.kid != "" {
+			header["kid"] = test.kid
+		}
+
+		token := signJWT(t, test.key, header, validClaims())
+
+		claims, err := c.verifyJWT(token)
+		if err != nil {
+			t.Errorf("%s: %s", test.alg, err)
+			continue
+		}
+
+		if claims["sub"] != "alice" {
+			t.Errorf("%s: claims %v", test.alg, claims)
+		}
+
+		// flip a bit of the signature
+		tampered := []byte(token)
+		tampered[len(tampered)-2] ^= 0x01
+		if _, err := c.verifyJWT(string(tampered)); err == nil {
+			t.Errorf("%s: accepted a tampered signature", test.alg)
+		}
+
+		// swap the claims for others, keeping the signature
+		parts := strings.Split(token, ".")
+		forged := signJWT(t, nil, header, map[string]interface{}{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()})
+		parts[1] = strings.Split(forged, ".")[1]
+		if _, err := c.verifyJWT(strings.Join(parts, ".")); err == nil {
+			t.Errorf("%s: accepted claims the signature is not for", test.alg)
+		}
+	}
+}
+
+func TestVerifyJWTAlgorithmConfusion(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	c := newJWTTestConfig(t, keys)
+
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(t, &keys.rsa.PublicKey)})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"none", signJWT(t, nil, map[string]interface{}{"alg": "none"}, validClaims())},
+		{"lower case none", signJWT(t, nil, map[string]interface{}{"alg": "None"}, validClaims())},
+		{"missing alg", signJWT(t, keys.rsa, map[string]interface{}{"kid": "rsa"}, validClaims())},
+		// the public key used as an hmac secret
+		{"hs256 with public key", signJWT(t, rsaPEM, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, validClaims())},
+		{"hs256 with modulus", signJWT(t, keys.rsa.N.Bytes(), map[string]interface{}{"alg": "HS256", "kid": "rsa"}, validClaims())},
+		// a valid signature, claimed to be another algorithm
+		{"rsa as es256", signJWT(t, keys.rsa, map[string]interface{}{"alg": jwtES256, "kid": "rsa"}, validClaims())},
+		{"ed25519 as rs256", signJWT(t, keys.ed, map[string]interface{}{"alg": jwtRS256}, validClaims())},
+		{"ecdsa as eddsa", signJWT(t, keys.ec, map[string]interface{}{"alg": jwtEdDSA, "kid": "ec"}, validClaims())},
+		// a key id of another type of key
+		{"es256 with rsa kid", signJWT(t, keys.ec, map[string]interface{}{"alg": jwtES256, "kid": "rsa"}, validClaims())},
+		{"unknown kid", signJWT(t, keys.ed, map[string]interface{}{"alg": jwtEdDSA, "kid": "other"}, validClaims())},
+		{"malformed", "a.b"},
+	}
+
+	// an asn.1 encoded ecdsa signature, as jws uses raw r || s
+	asn1 := strings.Split(signJWT(t, keys.ec, map[string]interface{}{"alg": jwtES256, "kid": "ec"}, validClaims()), ".")
+	digest := sha256.Sum256([]byte(asn1[0] + "." + asn1[1]))
+	der, err := ecdsa.SignASN1(rand.Reader, keys.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asn1[2] = b64url.EncodeToString(der)
+	tests = append(tests, struct {
+		name  string
+		token string
+	}{"es256 asn.1 signature", strings.Join(asn1, ".")})
+
+	for _, test := range tests {
+		if _, err := c.verifyJWT(test.token); err == nil {
+			t.Errorf("%s: token was accepted", test.name)
+		}
+	}
+}
+
+func mustMarshalPKIX(t *testing.T, pub crypto.PublicKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func TestCheckJWTClaims(t *testing.T) {
+	c := &Config{JWTIssuer: "https://idp.example.com", JWTAudience: "internal-api"}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		valid  bool
+	}{
+		{"valid", func(claims map[string]interface{}) {}, true},
+		{"no exp", func(claims map[string]interface{}) { delete(claims, "exp") }, false},
+		{"string exp", func(claims map[string]interface{}) { claims["exp"] = "9999999999" }, false},
+		{"expired", func(claims map[string]interface{}) { claims["exp"] = now.Add(-2 * jwtLeeway).Unix() }, false},
+		{"expired within leeway", func(claims map[string]interface{}) { claims["exp"] = now.Add(-jwtLeeway / 2).Unix() }, true},
+		{"not yet valid", func(claims map[string]interface{}) { claims["nbf"] = now.Add(2 * jwtLeeway).Unix() }, false},
+		{"nbf within leeway", func(claims map[string]interface{}) { claims["nbf"] = now.Add(jwtLeeway / 2).Unix() }, true},
+		{"fractional dates", func(claims map[string]interface{}) { claims["nbf"] = float64(now.Unix()) - 0.5 }, true},
+		{"other issuer", func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" }, false},
+		{"no issuer", func(claims map[string]interface{}) { delete(claims, "iss") }, false},
+		{"other audience", func(claims map[string]interface{}) { claims["aud"] = "other-api" }, false},
+		{"no audience", func(claims map[string]interface{}) { delete(claims, "aud") }, false},
+		{"audience list", func(claims map[string]interface{}) { claims["aud"] = []string{"other-api", "internal-api"} }, true},
+		{"audience list without", func(claims map[string]interface{}) { claims["aud"] = []string{"other-api"} }, false},
+		{"audience prefix", func(claims map[string]interface{}) { claims["aud"] = "internal-api-v2" }, false},
+	}
+
+	for _, test := range tests {
+		claims := validClaims()
+		test.change(claims)
+
+		// decode the claims the way verifyJWT does
+		raw, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+
+		var decoded map[string]interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.checkJWTClaims(decoded)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: claims were accepted", test.name)
+		}
+	}
+}
+
+func TestJWKSURLRequiresAudience(t *testing.T) {
+	keys := newJWTTestKeys(t)
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetches++
+		_, _ = rw.Write(keys.jwks(t))
+	}))
+	defer server.Close()
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.JWTJWKSURL = server.URL
+	c.JWTIssuer = "https://idp.example.com"
+
+	if err := c.Validate(); err == nil {
+		t.Fatal("jwtjwksurl was accepted without jwtaudience")
+	}
+
+	c.JWTAudience = "internal-api"
+	c.ForwardHeaders = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Header.Get("X-Trauth-User")))
+	})
+
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetches != 0 {
+		t.Errorf("jwks was fetched before it was used")
+	}
+
+	for _, aud := range []string{"internal-api", "other-api"} {
+		claims := validClaims()
+		claims["aud"] = aud
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+signJWT(t, keys.ed, map[string]interface{}{"alg": jwtEdDSA, "kid": "ed"}, claims))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if aud == "internal-api" && (rw.Code != http.StatusOK || rw.Body.String() != "alice") {
+			t.Errorf("token for %s responded %d %q, want 200 for alice", aud, rw.Code, rw.Body.String())
+		}
+
+		if aud == "other-api" && rw.Code != http.StatusUnauthorized {
+			t.Errorf("token for %s responded %d, want %d", aud, rw.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if fetches != 1 {
+		t.Errorf("jwks was fetched %d times, want once", fetches)
+	}
+}
@@ -0,0 +1,633 @@
+package trauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ldap protocol operations, as application tags.
+const (
+	ldapBindRequest     = berApplication | berConstructed | 0
+	ldapBindResponse    = berApplication | berConstructed | 1
+	ldapUnbindRequest   = berApplication | 2
+	ldapSearchRequest   = berApplication | berConstructed | 3
+	ldapSearchEntry     = berApplication | berConstructed | 4
+	ldapSearchDone      = berApplication | berConstructed | 5
+	ldapSearchReference = berApplication | berConstructed | 19
+)
+
+// search parameters.
+const (
+	ldapScopeSubtree      = 2
+	ldapNeverDerefAliases = 0
+	ldapNoAttributes      = `1.1`
+	ldapGroupNameAttr     = `cn`
+	ldapMaxGroups         = 1000
+)
+
+// ldap result codes trauth cares about.
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// defaults for the ldap options.
+const (
+	ldapDefaultUserFilter  = `(uid=%s)`
+	ldapDefaultGroupFilter = `(member=%s)`
+	ldapDefaultGroupAttr   = `memberOf`
+)
+
+// errLDAPRejected is returned when a directory does not accept a
+// username and password, as opposed to it not being usable at all.
+var errLDAPRejected = errors.New("credentials rejected")
+
+// ldapDirectory verifies passwords against an LDAP server by searching
+// for the user's entry with a service account, then binding as it.
+type ldapDirectory struct {
+	address      string
+	tls          *tls.Config
+	timeout      time.Duration
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	groupAttr    string
+	groupBaseDN  string
+	groupFilter  string
+}
+
+// newLDAPDirectory prepares a directory from the ldap options.
+func newLDAPDirectory(c *Config) (*ldapDirectory, error) {
+
+	u, err := url.Parse(c.LDAPURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldapurl with error: %s", err)
+	}
+
+	d := &ldapDirectory{
+		timeout:      time.Duration(c.LDAPTimeout) * time.Second,
+		bindDN:       c.LDAPBindDN,
+		bindPassword: c.LDAPBindPassword,
+		baseDN:       c.LDAPBaseDN,
+		userFilter:   c.LDAPUserFilter,
+		groupAttr:    c.LDAPGroupAttribute,
+		groupBaseDN:  c.LDAPGroupBaseDN,
+		groupFilter:  c.LDAPGroupFilter,
+	}
+
+	switch u.Scheme {
+	case "ldap":
+		d.address = net.JoinHostPort(u.Hostname(), portOr(u.Port(), "389"))
+	case "ldaps":
+		d.address = net.JoinHostPort(u.Hostname(), portOr(u.Port(), "636"))
+		d.tls = &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: c.LDAPInsecureSkipVerify,
+		}
+
+		if c.LDAPCAFile != "" {
+			pem, err := os.ReadFile(c.LDAPCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read ldapcafile with error: %s", err)
+			}
+
+			d.tls.RootCAs = x509.NewCertPool()
+			if !d.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in ldapcafile %s", c.LDAPCAFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ldapurl must use ldap:// or ldaps://, not '%s'", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("ldapurl %s has no host", c.LDAPURL)
+	}
+
+	if d.baseDN == "" {
+		return nil, fmt.Errorf("ldapbasedn is required with ldapurl")
+	}
+
+	if d.timeout <= 0 {
+		d.timeout = 5 * time.Second
+	}
+
+	if d.userFilter == "" {
+		d.userFilter = ldapDefaultUserFilter
+	}
+
+	if d.groupBaseDN != "" && d.groupFilter == "" {
+		d.groupFilter = ldapDefaultGroupFilter
+	}
+
+	if d.groupBaseDN == "" && d.groupAttr == "" {
+		d.groupAttr = ldapDefaultGroupAttr
+	}
+
+	// catch broken filters now rather than on the first login
+	if _, err := compileLDAPFilter(strings.ReplaceAll(d.userFilter, "%s", "x")); err != nil {
+		return nil, fmt.Errorf("invalid ldapuserfilter with error: %s", err)
+	}
+
+	if d.groupFilter != "" {
+		if _, err := compileLDAPFilter(strings.ReplaceAll(d.groupFilter, "%s", "x")); err != nil {
+			return nil, fmt.Errorf("invalid ldapgroupfilter with error: %s", err)
+		}
+	}
+
+	return d, nil
+}
+
+func portOr(port, def string) string {
+	if port == "" {
+		return def
+	}
+
+	return port
+}
+
+// authenticate verifies a username and password, returning the names of
+// the groups the user is a member of. errLDAPRejected is returned for
+// unknown users and wrong passwords.
+func (d *ldapDirectory) authenticate(user, pass string) ([]string, error) {
+
+	// a simple bind with an empty password is an anonymous bind, which
+	// most servers accept. never let that count as a valid login.
+	if user == "" || pass == "" {
+		return nil, errLDAPRejected
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := conn.serviceBind(d); err != nil {
+		return nil, err
+	}
+
+	attrs := []string{ldapNoAttributes}
+	if d.groupAttr != "" {
+		attrs = []string{d.groupAttr}
+	}
+
+	entries, err := conn.search(d.baseDN,
+		strings.ReplaceAll(d.userFilter, "%s", ldapEscape(user)), attrs, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("%w: %d entries match %s", errLDAPRejected, len(entries), user)
+	}
+
+	entry := entries[0]
+
+	code, msg, err := conn.bind(entry.dn, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	if code == ldapInvalidCredentials {
+		return nil, errLDAPRejected
+	}
+
+	if code != ldapSuccess {
+		return nil, fmt.Errorf("bind as %s failed with result %d: %s", entry.dn, code, msg)
+	}
+
+	var groups []string
+	for _, dn := range entry.attrs[strings.ToLower(d.groupAttr)] {
+		if name := ldapFirstRDN(dn); name != "" {
+			groups = append(groups, name)
+		}
+	}
+
+	if d.groupBaseDN != "" {
+		// the user may not be allowed to search groups, go back to
+		// the service account for that
+		if err := conn.serviceBind(d); err != nil {
+			return nil, err
+		}
+
+		found, err := conn.search(d.groupBaseDN,
+			strings.ReplaceAll(d.groupFilter, "%s", ldapEscape(entry.dn)),
+			[]string{ldapGroupNameAttr}, ldapMaxGroups)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, g := range found {
+			if names := g.attrs[ldapGroupNameAttr]; len(names) > 0 {
+				groups = append(groups, names[0])
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// ldapConn is a connection to a directory server, used for a single
+// authentication.
+type ldapConn struct {
+	conn net.Conn
+	id   int
+}
+
+// ldapEntry is a search result.
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// dial connects to the directory. the deadline covers the whole
+// authentication, not just the connect.
+func (d *ldapDirectory) dial() (*ldapConn, error) {
+
+	dialer := &net.Dialer{Timeout: d.timeout}
+
+	var conn net.Conn
+	var err error
+	if d.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", d.address, d.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", d.address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s with error: %s", d.address, err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &ldapConn{conn: conn}, nil
+}
+
+// close unbinds and closes the connection.
+func (c *ldapConn) close() {
+	c.id++
+	_, _ = c.conn.Write(berTLV(berSequence, berInt(berInteger, c.id), berTLV(ldapUnbindRequest)))
+	c.conn.Close()
+}
+
+// send writes a request, returning its message id.
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.id++
+	if _, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.id), op)); err != nil {
+		return 0, fmt.Errorf("failed to write ldap request with error: %s", err)
+	}
+
+	return c.id, nil
+}
+
+// receive reads the next response to a request, returning its
+// protocol operation.
+func (c *ldapConn) receive(id int) (*berPacket, error) {
+
+	for {
+		msg, err := readBER(c.conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ldap response with error: %s", err)
+		}
+
+		if msg.tag != berSequence || len(msg.children) < 2 {
+			return nil, fmt.Errorf("malformed ldap response")
+		}
+
+		// unsolicited notifications have id 0, usually a notice of
+		// disconnection which the next read will report
+		if msg.child(0).int() != id {
+			continue
+		}
+
+		return msg.child(1), nil
+	}
+}
+
+// bind performs a simple bind, returning the result code and
+// diagnostic message of the server.
+func (c *ldapConn) bind(dn, pass string) (int, string, error) {
+
+	id, err := c.send(berTLV(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(berContext|0, pass),
+	))
+	if err != nil {
+		return 0, "", err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if op.tag != ldapBindResponse {
+		return 0, "", fmt.Errorf("unexpected ldap response 0x%02x to bind", op.tag)
+	}
+
+	return op.child(0).int(), string(op.child(2).value), nil
+}
+
+// serviceBind binds as the configured service account, if there is one.
+// without one, searches are made anonymously.
+func (c *ldapConn) serviceBind(d *ldapDirectory) error {
+
+	if d.bindDN == "" {
+		return nil
+	}
+
+	code, msg, err := c.bind(d.bindDN, d.bindPassword)
+	if err != nil {
+		return err
+	}
+
+	if code != ldapSuccess {
+		return fmt.Errorf("bind as %s failed with result %d: %s", d.bindDN, code, msg)
+	}
+
+	return nil
+}
+
+// search runs a subtree search, returning up to limit entries.
+func (c *ldapConn) search(base, filter string, attrs []string, limit int) ([]ldapEntry, error) {
+
+	f, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var selection [][]byte
+	for _, a := range attrs {
+		selection = append(selection, berString(berOctetString, a))
+	}
+
+	id, err := c.send(berTLV(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, ldapNeverDerefAliases),
+		berInt(berInteger, limit),
+		berInt(berInteger, 0), // the connection deadline limits time
+		berBool(false),
+		f,
+		berTLV(berSequence, selection...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchEntry:
+			entry := ldapEntry{dn: string(op.child(0).value), attrs: make(map[string][]string)}
+			for _, attr := range op.child(1).children {
+				name := strings.ToLower(string(attr.child(0).value))
+				for _, v := range attr.child(1).children {
+					entry.attrs[name] = append(entry.attrs[name], string(v.value))
+				}
+			}
+
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// referrals to other servers are not followed
+		case ldapSearchDone:
+			code := op.child(0).int()
+			if code != ldapSuccess && code != ldapSizeLimitExceeded {
+				return nil, fmt.Errorf("search of %s failed with result %d: %s",
+					base, code, op.child(2).value)
+			}
+
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected ldap response 0x%02x to search", op.tag)
+		}
+	}
+}
+
+// ldapEscape escapes a value for use in a search filter (RFC 4515).
+func ldapEscape(s string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// ldapUnescape decodes the \XX escapes of a filter value.
+func ldapUnescape(s string) (string, error) {
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape in filter value %q", s)
+		}
+
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in filter value %q", s)
+		}
+
+		b.Write(c)
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// ldapFirstRDN returns the value of the first component of a dn, which
+// is how groups listed in memberOf are named.
+func ldapFirstRDN(dn string) string {
+
+	var b strings.Builder
+	inValue := false
+
+	for i := 0; i < len(dn); i++ {
+		c := dn[i]
+		switch {
+		case c == '\\' && i+1 < len(dn):
+			i++
+			if inValue {
+				b.WriteByte(dn[i])
+			}
+		case c == ',' || c == '+':
+			return b.String()
+		case c == '=' && !inValue:
+			inValue = true
+		case inValue:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// compileLDAPFilter encodes a string search filter (RFC 4515).
+func compileLDAPFilter(s string) ([]byte, error) {
+
+	f, rest, err := parseLDAPFilter(strings.TrimSpace(s), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after filter", rest)
+	}
+
+	return f, nil
+}
+
+// parseLDAPFilter encodes the parenthesised filter at the start of s,
+// returning it along with what follows.
+func parseLDAPFilter(s string, depth int) ([]byte, string, error) {
+
+	if depth > 16 {
+		return nil, "", fmt.Errorf("filter nested too deep")
+	}
+
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", fmt.Errorf("filter %q does not start with (", s)
+	}
+
+	s = s[1:]
+
+	var f []byte
+	var err error
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(berContext | berConstructed | 0)
+		if s[0] == '|' {
+			tag = berContext | berConstructed | 1
+		}
+
+		var subs [][]byte
+		for s = s[1:]; strings.HasPrefix(s, "("); {
+			var sub []byte
+			if sub, s, err = parseLDAPFilter(s, depth+1); err != nil {
+				return nil, "", err
+			}
+
+			subs = append(subs, sub)
+		}
+
+		f = berTLV(tag, subs...)
+	case '!':
+		var sub []byte
+		if sub, s, err = parseLDAPFilter(s[1:], depth+1); err != nil {
+			return nil, "", err
+		}
+
+		f = berTLV(berContext|berConstructed|2, sub)
+	default:
+		end := strings.IndexByte(s, ')')
+		if end == -1 {
+			return nil, "", fmt.Errorf("unterminated filter %q", s)
+		}
+
+		if f, err = ldapFilterItem(s[:end]); err != nil {
+			return nil, "", err
+		}
+
+		s = s[end:]
+	}
+
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("filter is missing a )")
+	}
+
+	return f, s[1:], nil
+}
+
+// ldapFilterItem encodes a single attribute comparison.
+func ldapFilterItem(item string) ([]byte, error) {
+
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("invalid filter item %q", item)
+	}
+
+	attr, value := item[:eq], item[eq+1:]
+
+	tag := byte(berContext | berConstructed | 3)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = berContext | berConstructed | 5
+	case '<':
+		tag = berContext | berConstructed | 6
+	case '~':
+		tag = berContext | berConstructed | 8
+	}
+
+	if tag != berContext|berConstructed|3 {
+		attr = attr[:len(attr)-1]
+	} else if value == "*" {
+		return berString(berContext|7, attr), nil
+	} else if strings.Contains(value, "*") {
+		// literal asterisks are escaped, so these are all wildcards
+		parts := strings.Split(value, "*")
+
+		var subs [][]byte
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+
+			v, err := ldapUnescape(p)
+			if err != nil {
+				return nil, err
+			}
+
+			switch i {
+			case 0:
+				subs = append(subs, berString(berContext|0, v))
+			case len(parts) - 1:
+				subs = append(subs, berString(berContext|2, v))
+			default:
+				subs = append(subs, berString(berContext|1, v))
+			}
+		}
+
+		return berTLV(berContext|berConstructed|4,
+			berString(berOctetString, attr), berTLV(berSequence, subs...)), nil
+	}
+
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return berTLV(tag, berString(berOctetString, attr), berString(berOctetString, v)), nil
+}
@@ -0,0 +1,376 @@
+package trauth
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ldapTestEntry is an entry in the test directory.
+type ldapTestEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapTestServer is a minimal in-process LDAP server, answering binds
+// and searches from a fixed set of entries.
+type ldapTestServer struct {
+	listener net.Listener
+	entries  []ldapTestEntry
+
+	mu      sync.Mutex
+	binds   []string
+	filters [][]byte
+}
+
+const (
+	ldapTestBase     = `dc=example,dc=com`
+	ldapTestPeople   = `ou=people,dc=example,dc=com`
+	ldapTestGroups   = `ou=groups,dc=example,dc=com`
+	ldapTestService  = `cn=svc,dc=example,dc=com`
+	ldapTestServPass = `svcpass`
+)
+
+func newLDAPTestServer(t *testing.T) *ldapTestServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ldapTestServer{
+		listener: l,
+		entries: []ldapTestEntry{
+			{dn: ldapTestService, password: ldapTestServPass, attrs: map[string][]string{"cn": {"svc"}}},
+			{dn: "uid=alice," + ldapTestPeople, password: "alicepass", attrs: map[string][]string{
+				"uid":      {"alice"},
+				"memberof": {"cn=admins," + ldapTestGroups, `cn=dev\,ops,` + ldapTestGroups},
+			}},
+			{dn: "uid=al*," + ldapTestPeople, password: "starpass", attrs: map[string][]string{
+				"uid": {"al*"},
+			}},
+			{dn: "uid=bob," + ldapTestPeople, password: "bobpass", attrs: map[string][]string{
+				"uid": {"bob"},
+			}},
+			{dn: "cn=staff," + ldapTestGroups, attrs: map[string][]string{
+				"cn":     {"staff"},
+				"member": {"uid=alice," + ldapTestPeople, "uid=bob," + ldapTestPeople},
+			}},
+			{dn: "cn=deployers," + ldapTestGroups, attrs: map[string][]string{
+				"cn":     {"deployers"},
+				"member": {"uid=bob," + ldapTestPeople},
+			}},
+		},
+	}
+
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+
+	return s
+}
+
+func (s *ldapTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		msg, err := readBER(conn)
+		if err != nil {
+			return
+		}
+
+		id := msg.child(0).int()
+		op := msg.child(1)
+
+		reply := func(ops ...[]byte) {
+			for _, o := range ops {
+				_, _ = conn.Write(berTLV(berSequence, berInt(berInteger, id), o))
+			}
+		}
+
+		switch op.tag {
+		case ldapBindRequest:
+			dn, pass := string(op.child(1).value), string(op.child(2).value)
+
+			s.mu.Lock()
+			s.binds = append(s.binds, dn)
+			s.mu.Unlock()
+
+			code := ldapInvalidCredentials
+			if pass == "" {
+				// like most servers, an empty password is an anonymous bind
+				code = ldapSuccess
+			}
+
+			for _, e := range s.entries {
+				if e.dn == dn && e.password != "" && e.password == pass {
+					code = ldapSuccess
+				}
+			}
+
+			reply(ldapTestResult(ldapBindResponse, code))
+		case ldapSearchRequest:
+			base := string(op.child(0).value)
+			limit := op.child(3).int()
+			filter := op.child(6)
+
+			s.mu.Lock()
+			s.filters = append(s.filters, filter.value)
+			s.mu.Unlock()
+
+			var attrs []string
+			for _, a := range op.child(7).children {
+				attrs = append(attrs, strings.ToLower(string(a.value)))
+			}
+
+			var ops [][]byte
+			code := ldapSuccess
+			for _, e := range s.entries {
+				if !strings.HasSuffix(e.dn, ","+base) || !ldapTestMatch(filter, e) {
+					continue
+				}
+
+				if limit > 0 && len(ops) == limit {
+					code = ldapSizeLimitExceeded
+					break
+				}
+
+				ops = append(ops, ldapTestSearchEntry(e, attrs))
+			}
+
+			reply(append(ops, ldapTestResult(ldapSearchDone, code))...)
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// bindsSeen returns the dns bound as since the last call.
+func (s *ldapTestServer) bindsSeen() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	binds := s.binds
+	s.binds = nil
+
+	return binds
+}
+
+func (s *ldapTestServer) directory(t *testing.T, configure func(*Config)) *ldapDirectory {
+	t.Helper()
+
+	c := CreateConfig()
+	c.LDAPURL = "ldap://" + s.listener.Addr().String()
+	c.LDAPBaseDN = ldapTestPeople
+	c.LDAPBindDN = ldapTestService
+	c.LDAPBindPassword = ldapTestServPass
+	c.LDAPTimeout = 2
+
+	if configure != nil {
+		configure(c)
+	}
+
+	d, err := newLDAPDirectory(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func ldapTestResult(tag byte, code int) []byte {
+	return berTLV(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+}
+
+func ldapTestSearchEntry(e ldapTestEntry, attrs []string) []byte {
+	var list [][]byte
+	for _, a := range attrs {
+		var values [][]byte
+		for _, v := range e.attrs[a] {
+			values = append(values, berString(berOctetString, v))
+		}
+
+		if len(values) > 0 {
+			list = append(list, berTLV(berSequence, berString(berOctetString, a), berTLV(0x31, values...)))
+		}
+	}
+
+	return berTLV(ldapSearchEntry, berString(berOctetString, e.dn), berTLV(berSequence, list...))
+}
+
+// ldapTestMatch evaluates the filters the client can send against an entry.
+func ldapTestMatch(f *berPacket, e ldapTestEntry) bool {
+	switch f.tag {
+	case berContext | berConstructed | 0:
+		for _, c := range f.children {
+			if !ldapTestMatch(c, e) {
+				return false
+			}
+		}
+
+		return true
+	case berContext | berConstructed | 1:
+		for _, c := range f.children {
+			if ldapTestMatch(c, e) {
+				return true
+			}
+		}
+
+		return false
+	case berContext | berConstructed | 2:
+		return !ldapTestMatch(f.child(0), e)
+	case berContext | 7:
+		return len(e.attrs[strings.ToLower(string(f.value))]) > 0
+	case berContext | berConstructed | 3:
+		for _, v := range e.attrs[strings.ToLower(string(f.child(0).value))] {
+			if v == string(f.child(1).value) {
+				return true
+			}
+		}
+	case berContext | berConstructed | 4:
+		for _, v := range e.attrs[strings.ToLower(string(f.child(0).value))] {
+			rest, ok := v, true
+			for _, sub := range f.child(1).children {
+				part := string(sub.value)
+				switch sub.tag {
+				case berContext | 0:
+					ok = ok && strings.HasPrefix(rest, part)
+					rest = strings.TrimPrefix(rest, part)
+				case berContext | 1:
+					idx := strings.Index(rest, part)
+					ok = ok && idx >= 0
+					if idx >= 0 {
+						rest = rest[idx+len(part):]
+					}
+				case berContext | 2:
+					ok = ok && strings.HasSuffix(rest, part)
+				}
+			}
+
+			if ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLDAPSearchThenBind(t *testing.T) {
+	s := newLDAPTestServer(t)
+	d := s.directory(t, nil)
+
+	groups, err := d.authenticate("alice", "alicepass")
+	if err != nil {
+		t.Fatalf("authenticate: %s", err)
+	}
+
+	if want := []string{"admins", "dev,ops"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+
+	if binds, want := s.bindsSeen(), []string{ldapTestService, "uid=alice," + ldapTestPeople}; !reflect.DeepEqual(binds, want) {
+		t.Errorf("binds = %q, want %q", binds, want)
+	}
+}
+
+func TestLDAPWrongPassword(t *testing.T) {
+	s := newLDAPTestServer(t)
+	d := s.directory(t, nil)
+
+	for _, user := range []string{"alice", "nobody"} {
+		if _, err := d.authenticate(user, "wrong"); !errors.Is(err, errLDAPRejected) {
+			t.Errorf("authenticate(%q) error = %v, want errLDAPRejected", user, err)
+		}
+	}
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+	s := newLDAPTestServer(t)
+	d := s.directory(t, nil)
+
+	if _, err := d.authenticate("alice", ""); !errors.Is(err, errLDAPRejected) {
+		t.Errorf("authenticate error = %v, want errLDAPRejected", err)
+	}
+
+	if binds := s.bindsSeen(); len(binds) != 0 {
+		t.Errorf("empty password reached the server with binds %q", binds)
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	s := newLDAPTestServer(t)
+	d := s.directory(t, nil)
+
+	// unescaped, al* would be a substring filter matching alice
+	if _, err := d.authenticate("al*", "alicepass"); !errors.Is(err, errLDAPRejected) {
+		t.Errorf("wildcard username error = %v, want errLDAPRejected", err)
+	}
+
+	if _, err := d.authenticate("al*", "starpass"); err != nil {
+		t.Errorf("literal asterisk username: %s", err)
+	}
+
+	if _, err := d.authenticate("x)(uid=alice", "alicepass"); !errors.Is(err, errLDAPRejected) {
+		t.Errorf("filter injection error = %v, want errLDAPRejected", err)
+	}
+
+	s.mu.Lock()
+	filters := s.filters
+	s.mu.Unlock()
+
+	want, _ := compileLDAPFilter(`(uid=x\29\28uid=alice)`)
+	if got := berTLV(berContext|berConstructed|3, filters[len(filters)-1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("injected filter sent as %x, want %x", got, want)
+	}
+}
+
+func TestLDAPGroupSearch(t *testing.T) {
+	s := newLDAPTestServer(t)
+	d := s.directory(t, func(c *Config) {
+		c.LDAPGroupBaseDN = ldapTestGroups
+	})
+
+	groups, err := d.authenticate("bob", "bobpass")
+	if err != nil {
+		t.Fatalf("authenticate: %s", err)
+	}
+
+	if want := []string{"staff", "deployers"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+
+	// groups are searched as the service account, not the user
+	binds := s.bindsSeen()
+	if len(binds) != 3 || binds[2] != ldapTestService {
+		t.Errorf("binds = %q, want the service account last", binds)
+	}
+}
+
+func TestLDAPFirstRDN(t *testing.T) {
+	for dn, want := range map[string]string{
+		"cn=admins,ou=groups,dc=example,dc=com": "admins",
+		`cn=dev\,ops,ou=groups`:                 "dev,ops",
+		"cn=a+ou=b,dc=example":                  "a",
+		"":                                      "",
+	} {
+		if got := ldapFirstRDN(dn); got != want {
+			t.Errorf("ldapFirstRDN(%q) = %q, want %q", dn, got, want)
+		}
+	}
+}
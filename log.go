@@ -16,5 +16,14 @@ func NewLogger() *log.Logger {
 
 // debugLog is a helper to print logs for debugging purposes
 func debugLog(m string) {
-	os.Stdout.WriteString(fmt.Sprintf(" --> [trauth debug] %s", m))
+	os.Stdout.WriteString(fmt.Sprintf(" --> [trauth debug] %s\n", m))
+}
+
+// debugf logs a debug message if debugging is enabled for this instance.
+func (t *Trauth) debugf(format string, args ...interface{}) {
+	if !t.config.Debug {
+		return
+	}
+
+	debugLog(fmt.Sprintf("(%s) ", t.name) + fmt.Sprintf(format, args...))
 }
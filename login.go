@@ -0,0 +1,402 @@
+package trauth
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	loginPath         = reservedPath + `login`
+	loginPasswordPath = reservedPath + `login/password`
+
+	// loginCSRFTTL is how long the login page can be left open before
+	// its forms have to be reloaded.
+	loginCSRFTTL = time.Hour
+
+	// csrfHeader carries the csrf token of the login page on the json
+	// requests of passkey ceremonies.
+	csrfHeader = `X-Trauth-CSRF`
+)
+
+// Attempts allowed at the login form from a single client, per minute.
+const loginAttempts = 10
+
+// loginPageData is passed to the login page template.
+type loginPageData struct {
+	Realm         string
+	Redirect      string
+	Username      string
+	Authenticated bool
+	Password      bool
+	Passkeys      bool
+	Error         string
+	CSRF          string
+
+	// a radius challenge waiting for an answer
+	Challenge        string
+	ChallengeMessage string
+
+	// email login links
+	Email      bool
+	EmailSent  bool
+	EmailToken string
+}
+
+// loginPage is the trauth login page. Passkey ceremonies are done with
+// the browser's WebAuthn api, passwords and email addresses are posted
+// with a form.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Realm }}</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; display: flex; justify-content: center; margin-top: 10vh; }
+main { background: #fff; padding: 2em; border-radius: 6px; box-shadow: 0 1px 4px rgba(0,0,0,.2); min-width: 18em; }
+input { display: block; width: 100%; box-sizing: border-box; margin: .5em 0; padding: .6em; font-size: 1em; }
+button, a.button { display: block; width: 100%; box-sizing: border-box; margin: .5em 0; padding: .6em; font-size: 1em; text-align: center; }
+#status { color: #b00; min-height: 1.2em; }
+</style>
+</head>
+<body>
+<main>
+<h2>{{ .Realm }}</h2>
+{{ if .Authenticated }}<p>Signed in as <strong>{{ .Username }}</strong>.</p>{{ end }}
+{{ if .EmailToken }}
+<form method="post" action="/_trauth/login/email">
+<input type="hidden" name="rd" value="{{ .Redirect }}">
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+<input type="hidden" name="token" value="{{ .EmailToken }}">
+<button type="submit">Continue signing in</button>
+</form>
+{{ else }}
+{{ if .Passkeys }}
+<button id="login">{{ if .Authenticated }}Verify with a passkey{{ else }}Sign in with a passkey{{ end }}</button>
+{{ if .Authenticated }}<button id="register">Register a new passkey</button>{{ end }}
+{{ end }}
+{{ if and .Password (not .Authenticated) }}
+<form method="post" action="/_trauth/login/password">
+<input type="hidden" name="rd" value="{{ .Redirect }}">
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+{{ if .Challenge }}
+<p>{{ if .ChallengeMessage }}{{ .ChallengeMessage }}{{ else }}Additional verification is required.{{ end }}</p>
+<input type="hidden" name="challenge" value="{{ .Challenge }}">
+<input name="response" type="password" autocomplete="one-time-code" aria-label="Response" autofocus required>
+<button type="submit">Continue</button>
+{{ else }}
+<input name="username" autocomplete="username" placeholder="Username" aria-label="Username" required>
+<input name="password" type="password" autocomplete="current-password" placeholder="Password" aria-label="Password" required>
+<button type="submit">Sign in with a password</button>
+{{ end }}
+</form>
+{{ end }}
+{{ if and .Email (not .Authenticated) }}
+{{ if .EmailSent }}<p>If that address may sign in, a link has been emailed to it.</p>{{ else }}
+<form method="post" action="/_trauth/login/email">
+<input type="hidden" name="rd" value="{{ .Redirect }}">
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+<input name="email" type="email" autocomplete="email" placeholder="Email address" aria-label="Email address" required>
+<button type="submit">Email me a sign-in link</button>
+</form>
+{{ end }}
+{{ end }}
+{{ end }}
+<p id="status">{{ .Error }}</p>
+</main>
+<script>
+const rd = {{ .Redirect }};
+const csrf = {{ .CSRF }};
+const status = (msg) => document.getElementById("status").textContent = msg;
+const dec = (s) => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+const enc = (b) => btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+const post = async (path, body) => {
+  const r = await fetch("/_trauth/webauthn/" + path, {method: "POST", headers: {"Content-Type": "application/json", "X-Trauth-CSRF": csrf}, body: JSON.stringify(body || {})});
+  const j = await r.json();
+  if (!r.ok) throw new Error(j.error || r.statusText);
+  return j;
+};
+const login = document.getElementById("login");
+if (login) login.onclick = async () => {
+  try {
+    const o = await post("login/begin");
+    o.challenge = dec(o.challenge);
+    (o.allowCredentials || []).forEach(c => c.id = dec(c.id));
+    const c = await navigator.credentials.get({publicKey: o});
+    const r = await post("login/finish", {
+      id: c.id, rd: rd,
+      clientDataJSON: enc(c.response.clientDataJSON),
+      authenticatorData: enc(c.response.authenticatorData),
+      signature: enc(c.response.signature),
+    });
+    window.location = r.rd;
+  } catch (e) { status(e.message); }
+};
+const register = document.getElementById("register");
+if (register) register.onclick = async () => {
+  try {
+    const o = await post("register/begin");
+    o.challenge = dec(o.challenge);
+    o.user.id = dec(o.user.id);
+    (o.excludeCredentials || []).forEach(c => c.id = dec(c.id));
+    const c = await navigator.credentials.create({publicKey: o});
+    await post("register/finish", {
+      id: c.id,
+      clientDataJSON: enc(c.response.clientDataJSON),
+      attestationObject: enc(c.response.attestationObject),
+    });
+    status("Passkey registered.");
+  } catch (e) { status(e.message); }
+};
+</script>
+</body>
+</html>
+`))
+
+// wantsHTML checks if a request came from a browser navigating to a page.
+func wantsHTML(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// redirectToLogin sends a browser to the login page, to return to the
+// page it requested afterwards.
+func redirectToLogin(rw http.ResponseWriter, req *http.Request) {
+	target := url.URL{Path: loginPath, RawQuery: url.Values{"rd": {req.URL.RequestURI()}}.Encode()}
+	http.Redirect(rw, req, target.String(), http.StatusFound)
+}
+
+// usesLoginPage returns true if browsers are sent to the login page
+// rather than prompted for HTTP Basic credentials, which is needed for
+// passkeys, radius challenges and email links.
+func (c *Config) usesLoginPage() bool {
+	return c.webauthn != nil || c.radius != nil || c.email != nil
+}
+
+// setNonceCookie sets a short-lived cookie for the current host with a
+// random value, returning the value.
+func (t *Trauth) setNonceCookie(rw http.ResponseWriter, req *http.Request, name string, ttl time.Duration) string {
+
+	value := hex.EncodeToString(securecookie.GenerateRandomKey(16))
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   t.config.CookieSecure || requestScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return value
+}
+
+// nonceCookie returns the value of a cookie set by setNonceCookie, or
+// sets one if there is none. Keeping an existing value lets several
+// pages opened in other tabs share it.
+func (t *Trauth) nonceCookie(rw http.ResponseWriter, req *http.Request, name string, ttl time.Duration) string {
+
+	if cookie, err := req.Cookie(name); err == nil && len(cookie.Value) == 32 {
+		return cookie.Value
+	}
+
+	return t.setNonceCookie(rw, req, name, ttl)
+}
+
+// nonceCookieMatches checks a value against one set by setNonceCookie.
+func nonceCookieMatches(req *http.Request, name, value string) bool {
+	cookie, err := req.Cookie(name)
+	return err == nil && value != "" && hmac.Equal([]byte(cookie.Value), []byte(value))
+}
+
+// csrfCookieName names the cookie that login forms have to be posted with.
+func (c *Config) csrfCookieName() string {
+	return c.CookieName + "-csrf"
+}
+
+// csrfToken returns the token for the forms of the login page. The
+// token is kept in a cookie that other sites can not read, so only the
+// login page itself can post a form with it.
+func (t *Trauth) csrfToken(rw http.ResponseWriter, req *http.Request) string {
+	return t.nonceCookie(rw, req, t.config.csrfCookieName(), loginCSRFTTL)
+}
+
+// validCSRF checks the token a login form was posted with.
+func (t *Trauth) validCSRF(req *http.Request) bool {
+	return nonceCookieMatches(req, t.config.csrfCookieName(), req.PostFormValue("csrf"))
+}
+
+// renderLogin writes the login page.
+func (t *Trauth) renderLogin(rw http.ResponseWriter, req *http.Request, status int, data loginPageData) {
+
+	data.Realm = t.config.Realm
+	data.Password = t.config.hasPasswords()
+	data.Passkeys = t.config.webauthn != nil
+	data.Email = t.config.email != nil
+
+	if data.Password || data.Passkeys || data.Email {
+		data.CSRF = t.csrfToken(rw, req)
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+
+	if err := loginPage.Execute(rw, data); err != nil {
+		t.logger.Printf("failed to render login page: %s", err)
+	}
+}
+
+// loginLimited applies the per client limit of the login forms, showing
+// the login page with a 429 and returning true if a client is over it.
+func (t *Trauth) loginLimited(rw http.ResponseWriter, req *http.Request, rd string) bool {
+
+	key := req.RemoteAddr
+	if ip := clientIP(req); ip != nil {
+		key = ip.String()
+	}
+
+	allowed, _, reset := t.logins.take(key)
+	if allowed {
+		return false
+	}
+
+	t.logger.Printf("rate limited login form for %s", key)
+	rw.Header().Set("Retry-After", seconds(reset))
+	t.renderLogin(rw, req, http.StatusTooManyRequests, loginPageData{Redirect: rd, Error: "Too many attempts, try again later."})
+
+	return true
+}
+
+// serveLogin handles the login page and the password logins behind it,
+// returning false for paths that are not one of them.
+func (t *Trauth) serveLogin(rw http.ResponseWriter, req *http.Request, user User) bool {
+
+	rd := localRedirect(req.URL.Query().Get("rd"))
+
+	switch req.URL.Path {
+	case loginPath:
+		t.renderLogin(rw, req, http.StatusOK, loginPageData{
+			Redirect:      rd,
+			Username:      user.Username,
+			Authenticated: user.Authenticated,
+		})
+
+		return true
+	case loginPasswordPath:
+		if !t.config.hasPasswords() {
+			return false
+		}
+
+		t.serveFormLogin(rw, req)
+
+		return true
+	case loginEmailPath:
+		if t.config.email == nil {
+			return false
+		}
+
+		t.serveEmailLogin(rw, req)
+
+		return true
+	}
+
+	return false
+}
+
+// serveFormLogin checks the credentials posted by the login page, or
+// the answer to a radius challenge, creating a session when they are
+// valid.
+func (t *Trauth) serveFormLogin(rw http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, 64<<10)
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	rd := localRedirect(req.PostFormValue("rd"))
+
+	if !t.validCSRF(req) {
+		t.logger.Printf("refusing login form without a valid csrf token from %s", req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusForbidden, loginPageData{Redirect: rd, Error: "The form expired, try again."})
+		return
+	}
+
+	if t.loginLimited(rw, req, rd) {
+		return
+	}
+
+	var user User
+	var err error
+
+	if id := req.PostFormValue("challenge"); id != "" && t.config.radius != nil {
+		user, err = t.answerChallenge(id, req.PostFormValue("response"))
+	} else {
+		user, err = t.checkCredentials(req.PostFormValue("username"), req.PostFormValue("password"))
+	}
+
+	var challenge *radiusChallenge
+	if errors.As(err, &challenge) {
+		t.config.radius.hold(challenge)
+		t.renderLogin(rw, req, http.StatusUnauthorized, loginPageData{
+			Redirect:         rd,
+			Challenge:        challenge.id,
+			ChallengeMessage: challenge.message,
+		})
+		return
+	}
+
+	if err != nil {
+		t.logger.Printf("failed login for %q from %s using the login form", req.PostFormValue("username"), req.RemoteAddr)
+		t.renderLogin(rw, req, http.StatusUnauthorized, loginPageData{Redirect: rd, Error: "Invalid username or password."})
+		return
+	}
+
+	if _, err := setUser(t.config, user.Username, user.Method, user.Groups, rw, req); err != nil {
+		t.sessionFailed(rw, err)
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using the login form", user.Username, req.RemoteAddr)
+	http.Redirect(rw, req, rd, http.StatusSeeOther)
+}
+
+// answerChallenge continues a radius login with the user's response to
+// the challenge a server sent.
+func (t *Trauth) answerChallenge(id, response string) (User, error) {
+
+	challenge, ok := t.config.radius.take(id)
+	if !ok {
+		return User{}, errInvalidCredentials
+	}
+
+	groups, err := t.config.radius.answer(challenge, response)
+
+	// servers may ask more than once, such as for a new pin
+	var next *radiusChallenge
+	if errors.As(err, &next) {
+		next.method = challenge.method
+		return User{}, next
+	}
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{Username: challenge.username, Authenticated: true, Method: challenge.method, Groups: groups}, nil
+}
@@ -0,0 +1,345 @@
+package trauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a
+// MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdb data section field types.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+// mmdbReader is a minimal reader for MaxMind DB files, as used by the
+// GeoLite2 and GeoIP2 databases. It only supports what trauth needs,
+// looking up the record for an address.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint
+}
+
+// openMMDB reads a MaxMind DB file into memory.
+func openMMDB(path string) (*mmdbReader, error) {
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if idx == -1 {
+		return nil, fmt.Errorf("%s is not a maxmind db file", path)
+	}
+
+	meta := buf[idx+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbReader{data: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata of %s: %s", path, err)
+	}
+
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata in %s", path)
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount, _ = toUint(metadata["node_count"])
+	r.recordSize, _ = toUint(metadata["record_size"])
+	r.ipVersion, _ = toUint(metadata["ip_version"])
+	r.dbType, _ = metadata["database_type"].(string)
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d in %s", r.recordSize, path)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(idx) {
+		return nil, fmt.Errorf("search tree of %s is larger than the file", path)
+	}
+
+	r.data = buf[treeSize+16 : idx]
+
+	// ipv4 addresses live under ::/96 in an ipv6 tree
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// toUint converts the unsigned types the decoder produces.
+func toUint(v interface{}) (uint, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n), true
+	case uint32:
+		return uint(n), true
+	case uint16:
+		return uint(n), true
+	}
+
+	return 0, false
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the decoded record for an address, or nil if the
+// database has no record for it.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+
+	node := uint(0)
+	bits := ip.To16()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+
+	if node < r.nodeCount+16 {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+
+	offset := node - r.nodeCount - 16
+	v, _, err := r.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	record, _ := v.(map[string]interface{})
+
+	return record, nil
+}
+
+// decode reads the value at offset in the data section, returning it
+// along with the offset of the next value.
+func (r *mmdbReader) decode(offset uint, depth int) (interface{}, uint, error) {
+
+	if depth > 32 {
+		return nil, 0, fmt.Errorf("data section nested too deep")
+	}
+
+	if offset >= uint(len(r.data)) {
+		return nil, 0, fmt.Errorf("offset %d outside of data section", offset)
+	}
+
+	ctrl := r.data[offset]
+	offset++
+
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ss := uint(ctrl>>3) & 3
+		vvv := uint(ctrl & 7)
+
+		b, err := r.bytes(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(b[0])
+		case 1:
+			ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		case 3:
+			ptr = uint(binary.BigEndian.Uint32(b))
+		}
+
+		v, _, err := r.decode(ptr, depth+1)
+
+		return v, offset + ss + 1, err
+	}
+
+	if typ == mmdbExtended {
+		b, err := r.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		b, err := r.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offset += n
+
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 31:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+
+			v, next, err := r.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			m[key] = v
+			offset = next
+		}
+
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+			offset = next
+		}
+
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err := r.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		// uint128 values are truncated, nothing trauth reads uses them
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+
+		return int32(n), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
+
+// bytes returns n bytes of the data section starting at offset.
+func (r *mmdbReader) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(r.data)) {
+		return nil, fmt.Errorf("value at %d runs past the data section", offset)
+	}
+
+	return r.data[offset : offset+n], nil
+}
@@ -0,0 +1,464 @@
+package trauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mmdbTestPointer is a value the fixture writer stores as a pointer to
+// an earlier offset in the data section.
+type mmdbTestPointer uint
+
+// mmdbTestNetwork is a network and the record stored for it.
+type mmdbTestNetwork struct {
+	cidr   string
+	record interface{}
+}
+
+// mmdbTestEncode appends a value to the data section in the MaxMind DB
+// format.
+func mmdbTestEncode(t *testing.T, buf *bytes.Buffer, v interface{}) {
+	t.Helper()
+
+	switch v := v.(type) {
+	case mmdbTestPointer:
+		if v >= 2048 {
+			t.Fatalf("pointer %d too large for the fixture writer", v)
+		}
+
+		buf.WriteByte(mmdbPointer<<5 | byte(v>>8))
+		buf.WriteByte(byte(v))
+	case string:
+		mmdbTestControl(buf, mmdbString, uint(len(v)))
+		buf.WriteString(v)
+	case []byte:
+		mmdbTestControl(buf, mmdbBytes, uint(len(v)))
+		buf.Write(v)
+	case float64:
+		mmdbTestControl(buf, mmdbDouble, 8)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		mmdbTestControl(buf, mmdbFloat, 4)
+		_ = binary.Write(buf, binary.BigEndian, math.Float32bits(v))
+	case uint16:
+		mmdbTestControl(buf, mmdbUint16, 2)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		mmdbTestControl(buf, mmdbUint32, 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		mmdbTestControl(buf, mmdbUint64, 8)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case int32:
+		mmdbTestControl(buf, mmdbInt32, 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case bool:
+		size := uint(0)
+		if v {
+			size = 1
+		}
+
+		mmdbTestControl(buf, mmdbBool, size)
+	case []interface{}:
+		mmdbTestControl(buf, mmdbArray, uint(len(v)))
+		for _, e := range v {
+			mmdbTestEncode(t, buf, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		mmdbTestControl(buf, mmdbMap, uint(len(v)))
+		for _, k := range keys {
+			mmdbTestEncode(t, buf, k)
+			mmdbTestEncode(t, buf, v[k])
+		}
+	default:
+		t.Fatalf("fixture writer can not encode %T", v)
+	}
+}
+
+// mmdbTestControl appends the control byte(s) for a type and size.
+func mmdbTestControl(buf *bytes.Buffer, typ byte, size uint) {
+
+	var ctrl byte
+	var extra []byte
+
+	switch {
+	case size < 29:
+		ctrl = byte(size)
+	case size < 285:
+		ctrl, extra = 29, []byte{byte(size - 29)}
+	default:
+		size -= 285
+		ctrl, extra = 30, []byte{byte(size >> 8), byte(size)}
+	}
+
+	if typ > 7 {
+		buf.WriteByte(ctrl)
+		buf.WriteByte(typ - 7)
+	} else {
+		buf.WriteByte(typ<<5 | ctrl)
+	}
+
+	buf.Write(extra)
+}
+
+// writeTestMMDB writes a MaxMind DB file with the given networks and
+// returns its path. In ipv6 databases, ipv4 networks are stored under
+// ::/96.
+func writeTestMMDB(t *testing.T, ipVersion, recordSize uint, networks []mmdbTestNetwork, shared ...interface{}) string {
+	t.Helper()
+
+	// values shared between records are written first, so that records
+	// can point to them
+	var data bytes.Buffer
+	for _, v := range shared {
+		mmdbTestEncode(t, &data, v)
+	}
+
+	// children are node numbers, or -1 for no record, or -2-offset for
+	// a record in the data section
+	nodes := [][2]int{{-1, -1}}
+
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		bits := []byte(ipnet.IP)
+
+		if ipVersion == 6 && len(bits) == net.IPv4len {
+			bits = append(make([]byte, 12), bits...)
+			ones += 96
+		}
+
+		offset := data.Len()
+		mmdbTestEncode(t, &data, n.record)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := bits[i/8] >> (7 - uint(i%8)) & 1
+
+			if i == ones-1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+
+			// a more specific network splits a record into a node
+			// that keeps it on both sides
+			if child := nodes[node][bit]; child < 0 {
+				nodes = append(nodes, [2]int{child, child})
+				nodes[node][bit] = len(nodes) - 1
+			}
+
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	value := func(child int) uint {
+		switch {
+		case child == -1:
+			return nodeCount
+		case child < -1:
+			return nodeCount + 16 + uint(-2-child)
+		}
+
+		return uint(child)
+	}
+
+	var file bytes.Buffer
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+
+		switch recordSize {
+		case 24:
+			file.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left)})
+			file.Write([]byte{byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			file.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left)})
+			file.WriteByte(byte(left>>24)<<4 | byte(right>>24)&0x0F)
+			file.Write([]byte{byte(right >> 16), byte(right >> 8), byte(right)})
+		case 32:
+			_ = binary.Write(&file, binary.BigEndian, uint32(left))
+			_ = binary.Write(&file, binary.BigEndian, uint32(right))
+		}
+	}
+
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.Write(mmdbMetadataMarker)
+
+	mmdbTestEncode(t, &file, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "Test",
+		"ip_version":                  uint16(ipVersion),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func mmdbTestCountry(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": code, "geoname_id": uint32(1)},
+	}
+}
+
+func TestMMDBLookupIPv4(t *testing.T) {
+	path := writeTestMMDB(t, 4, 24, []mmdbTestNetwork{
+		{"192.0.2.0/24", mmdbTestCountry("NL")},
+		{"198.51.100.128/25", mmdbTestCountry("DE")},
+	})
+
+	r, err := openMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.dbType != "Test" || r.ipVersion != 4 {
+		t.Errorf("metadata read as type %q, ip version %d", r.dbType, r.ipVersion)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "NL"},
+		{"192.0.2.255", "NL"},
+		{"198.51.100.200", "DE"},
+		{"198.51.100.1", ""},
+		{"203.0.113.1", ""},
+		{"::ffff:192.0.2.1", "NL"},
+		{"2001:db8::1", ""},
+	}
+
+	for _, test := range tests {
+		record, err := r.lookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("%s: %s", test.ip, err)
+			continue
+		}
+
+		if got := countryCode(record); got != test.want {
+			t.Errorf("%s: country %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestMMDBLookupIPv6(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		path := writeTestMMDB(t, 6, recordSize, []mmdbTestNetwork{
+			{"2001:db8::/32", mmdbTestCountry("SE")},
+			{"2001:db8:1::/48", mmdbTestCountry("NO")},
+			{"192.0.2.0/24", mmdbTestCountry("NL")},
+		})
+
+		r, err := openMMDB(path)
+		if err != nil {
+			t.Fatalf("record size %d: %s", recordSize, err)
+		}
+
+		tests := []struct {
+			ip   string
+			want string
+		}{
+			{"2001:db8::1", "SE"},
+			{"2001:db8:ffff::1", "SE"},
+			{"2001:db8:1::1", "NO"},
+			{"2001:db9::1", ""},
+			{"192.0.2.1", "NL"},
+			{"::ffff:192.0.2.1", "NL"},
+			{"198.51.100.1", ""},
+		}
+
+		for _, test := range tests {
+			record, err := r.lookup(net.ParseIP(test.ip))
+			if err != nil {
+				t.Errorf("record size %d, %s: %s", recordSize, test.ip, err)
+				continue
+			}
+
+			if got := countryCode(record); got != test.want {
+				t.Errorf("record size %d, %s: country %q, want %q", recordSize, test.ip, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMMDBDecodeTypes(t *testing.T) {
+	long := strings.Repeat("x", 300)
+
+	record := map[string]interface{}{
+		"array":   []interface{}{uint16(1), "two", true},
+		"bytes":   []byte{0xde, 0xad},
+		"double":  1.5,
+		"false":   false,
+		"float":   float32(0.25),
+		"int32":   int32(-7),
+		"long":    long,
+		"medium":  strings.Repeat("y", 100),
+		"pointer": mmdbTestPointer(0),
+		"uint64":  uint64(1) << 40,
+	}
+
+	path := writeTestMMDB(t, 4, 24, []mmdbTestNetwork{{"192.0.2.0/24", record}}, "shared")
+
+	r, err := openMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.lookup(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"array":   []interface{}{uint64(1), "two", true},
+		"bytes":   []byte{0xde, 0xad},
+		"double":  1.5,
+		"false":   false,
+		"float":   float32(0.25),
+		"int32":   int32(-7),
+		"long":    long,
+		"medium":  strings.Repeat("y", 100),
+		"pointer": "shared",
+		"uint64":  uint64(1) << 40,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, want %#v", got, want)
+	}
+}
+
+func TestGeoDBLookup(t *testing.T) {
+	// the anonymous network only has a registered country, which is
+	// shared through a pointer
+	country := writeTestMMDB(t, 6, 28, []mmdbTestNetwork{
+		{"192.0.2.0/24", mmdbTestCountry("nl")},
+		{"2001:db8::/32", map[string]interface{}{"registered_country": mmdbTestPointer(0)}},
+	}, map[string]interface{}{"iso_code": "SE"})
+
+	asn := writeTestMMDB(t, 6, 24, []mmdbTestNetwork{
+		{"192.0.2.0/25", map[string]interface{}{"autonomous_system_number": uint32(64500)}},
+		{"2001:db8::/32", map[string]interface{}{"autonomous_system_number": uint32(64501)}},
+	})
+
+	db, err := newGeoDB(country, asn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want geoLocation
+	}{
+		{"192.0.2.1", geoLocation{Country: "NL", ASN: 64500}},
+		{"192.0.2.200", geoLocation{Country: "NL"}},
+		{"2001:db8::1", geoLocation{Country: "SE", ASN: 64501}},
+		{"203.0.113.1", geoLocation{}},
+	}
+
+	for _, test := range tests {
+		if got := db.lookup(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestOpenMMDBInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage.mmdb")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openMMDB(garbage); err == nil {
+		t.Errorf("opened a file without metadata")
+	}
+
+	// cut the search tree short, keeping the metadata
+	buf, err := os.ReadFile(writeTestMMDB(t, 6, 24, []mmdbTestNetwork{{"2001:db8::/32", mmdbTestCountry("SE")}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := filepath.Join(dir, "truncated.mmdb")
+	if err := os.WriteFile(truncated, buf[bytes.LastIndex(buf, mmdbMetadataMarker)-20:], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openMMDB(truncated); err == nil {
+		t.Errorf("opened a database with a truncated search tree")
+	}
+}
+
+func TestMMDBLargeRecords(t *testing.T) {
+	// a record of padding pushes the networks after it past 1<<24, where
+	// the 28 bit layout keeps the top of both records of a node in a
+	// shared byte
+	var padding []interface{}
+	for size := 0; size <= 1<<24; size += 60000 {
+		padding = append(padding, make([]byte, 60000))
+	}
+
+	layouts := [][]mmdbTestNetwork{
+		{
+			{"0.0.0.0/2", mmdbTestCountry("NL")},
+			{"64.0.0.0/2", padding},
+			{"128.0.0.0/1", mmdbTestCountry("DE")},
+		},
+		{
+			{"128.0.0.0/2", mmdbTestCountry("NL")},
+			{"192.0.0.0/2", padding},
+			{"0.0.0.0/1", mmdbTestCountry("DE")},
+		},
+	}
+
+	for _, recordSize := range []uint{28, 32} {
+		for idx, networks := range layouts {
+			r, err := openMMDB(writeTestMMDB(t, 4, recordSize, networks))
+			if err != nil {
+				t.Fatalf("record size %d, layout %d: %s", recordSize, idx, err)
+			}
+
+			for _, n := range []mmdbTestNetwork{networks[0], networks[2]} {
+				ip, _, _ := net.ParseCIDR(n.cidr)
+				want := countryCode(n.record.(map[string]interface{}))
+
+				record, err := r.lookup(ip)
+				if err != nil {
+					t.Errorf("record size %d, %s: %s", recordSize, ip, err)
+					continue
+				}
+
+				if got := countryCode(record); got != want {
+					t.Errorf("record size %d, %s: country %q, want %q", recordSize, ip, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package trauth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// normalizePath cleans a request path before rules match against it.
+// Duplicate slashes and dot segments are removed so that paths such as
+// //admin or /api/../admin can not be used to get around a rule. The
+// path is expected to be percent-decoded already, as url.URL.Path is.
+func normalizePath(p string) string {
+
+	if p == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + p)
+
+	// keep a trailing slash, it is significant to many applications
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// globPattern matches paths against a glob such as /api/*/public/**.
+//
+// A * or ? matches within a single path segment, while a ** segment
+// matches any number of segments, including none.
+type globPattern struct {
+	segments []string
+}
+
+func compileGlob(pattern string) (*globPattern, error) {
+
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("glob '%s' must start with a /", pattern)
+	}
+
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for _, segment := range segments {
+		if segment != "**" && strings.Contains(segment, "**") {
+			return nil, fmt.Errorf("glob '%s' may only use ** as a full path segment", pattern)
+		}
+
+		// let path.Match tell us about malformed patterns early
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob '%s': %s", pattern, err)
+		}
+	}
+
+	return &globPattern{segments: segments}, nil
+}
+
+// match checks a normalized path against the glob.
+func (g *globPattern) match(p string) bool {
+	return matchSegments(g.segments, strings.Split(strings.TrimPrefix(p, "/"), "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try every possible number of segments for the **
+			for skip := 0; skip <= len(segments); skip++ {
+				if matchSegments(pattern[1:], segments[skip:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
@@ -0,0 +1,76 @@
+package trauth
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"//admin", "/admin"},
+		{"/api//v1///users", "/api/v1/users"},
+		{"/api/../admin", "/admin"},
+		{"/api/./admin/", "/api/admin/"},
+		{"/../../admin", "/admin"},
+		{"/api/..", "/"},
+		{"admin", "/admin"},
+	}
+
+	for _, test := range tests {
+		if got := normalizePath(test.path); got != test.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"/api/*/public", "/api/v1/public", true},
+		{"/api/*/public", "/api/v1/v2/public", false},
+		{"/api/*/public", "/api/public", false},
+		{"/api/v?/status", "/api/v2/status", true},
+		{"/api/v?/status", "/api/v10/status", false},
+		{"/static/*.css", "/static/site.css", true},
+		{"/static/*.css", "/static/css/site.css", false},
+		{"/static/**", "/static/css/site.css", true},
+		{"/static/**", "/static/", true},
+		{"/static/**", "/static", true},
+		{"/static/**", "/staticfiles/site.css", false},
+		{"/api/**/public", "/api/public", true},
+		{"/api/**/public", "/api/v1/users/public", true},
+		{"/api/**/public", "/api/v1/users/public/secret", false},
+		{"/**/*.js", "/app.js", true},
+		{"/**/*.js", "/assets/js/app.js", true},
+		{"/**/*.js", "/assets/js/app.json", false},
+		{"/**", "/", true},
+		{"/health", "/health", true},
+		{"/health", "/health/", false},
+	}
+
+	for _, test := range tests {
+		glob, err := compileGlob(test.glob)
+		if err != nil {
+			t.Fatalf("%s: %s", test.glob, err)
+		}
+
+		if got := glob.match(test.path); got != test.match {
+			t.Errorf("glob %s matching %s = %t, want %t", test.glob, test.path, got, test.match)
+		}
+	}
+}
+
+func TestGlobInvalid(t *testing.T) {
+	for _, pattern := range []string{"api/*", "/api/a**", "/api/**b/x", "/api/[a-"} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("glob %s was accepted", pattern)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package trauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// compileTrustedProxies validates the options for identities asserted
+// by a proxy in front of trauth.
+func (c *Config) compileTrustedProxies() error {
+
+	if c.TrustedHeader == "" {
+		if len(c.TrustedProxies) > 0 || c.TrustedProxyCert != "" {
+			return fmt.Errorf("trustedproxies and trustedproxycert need a trustedheader")
+		}
+
+		return nil
+	}
+
+	if len(c.TrustedProxies) == 0 && c.TrustedProxyCert == "" {
+		return fmt.Errorf("trustedheader needs trustedproxies or a trustedproxycert")
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		network, err := parseNetwork(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy '%s' with error: %s", cidr, err)
+		}
+
+		c.trustedNets = append(c.trustedNets, network)
+	}
+
+	if c.TrustedProxyCert != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(c.TrustedProxyCert, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return fmt.Errorf("trustedproxycert must be a hex encoded sha256 certificate fingerprint")
+		}
+
+		c.trustedCert = fingerprint
+	}
+
+	return nil
+}
+
+// trustedPeer checks if the immediate peer of a request is a trusted
+// proxy, either by its address or the certificate it presented.
+func (c *Config) trustedPeer(req *http.Request) bool {
+
+	if peer := clientIP(req); peer != nil {
+		for _, network := range c.trustedNets {
+			if network.Contains(peer) {
+				return true
+			}
+		}
+	}
+
+	if c.trustedCert != nil && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(req.TLS.PeerCertificates[0].Raw)
+		return subtle.ConstantTimeCompare(sum[:], c.trustedCert) == 1
+	}
+
+	return false
+}
+
+// assertedIdentity returns the user a trusted proxy says a request is
+// from. the header is removed from requests of anyone else, so that it
+// never reaches the service unless a trusted proxy set it.
+func (t *Trauth) assertedIdentity(req *http.Request) string {
+
+	if t.config.TrustedHeader == "" {
+		return ""
+	}
+
+	name := strings.TrimSpace(req.Header.Get(t.config.TrustedHeader))
+	if name == "" {
+		return ""
+	}
+
+	if !t.config.trustedPeer(req) {
+		t.logger.Printf("ignoring %s header from untrusted peer %s", t.config.TrustedHeader, req.RemoteAddr)
+		req.Header.Del(t.config.TrustedHeader)
+		return ""
+	}
+
+	return name
+}
+
+// tryProxyAuth creates a session for a user asserted by a trusted proxy.
+func (t *Trauth) tryProxyAuth(rw http.ResponseWriter, req *http.Request, rule *Rule, name string) {
+
+	if t.statelessRequest(req, rule) {
+		t.forward(rw, req, User{Username: name, Authenticated: true, Method: authMethodProxy}, rule)
+		return
+	}
+
+	user, err := setUser(t.config, name, authMethodProxy, nil, rw, req)
+	if err != nil {
+		t.sessionFailed(rw, err)
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using the %s header of a trusted proxy",
+		name, req.RemoteAddr, t.config.TrustedHeader)
+	t.completeLogin(rw, req, user, rule)
+}
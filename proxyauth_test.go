@@ -0,0 +1,122 @@
+package trauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedHeaderFromUntrustedPeer(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.TrustedHeader = "X-Forwarded-User"
+	c.TrustedProxies = []string{"10.0.0.0/8"}
+	c.Rules = []Rule{{Domain: "example.com", Action: actionAllow, Excludes: []Exclude{{PathPrefix: "/public/"}}}}
+
+	passed := false
+	var asserted []string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		passed, asserted = true, req.Header.Values("X-Forwarded-User")
+	})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		path       string
+		passed     bool
+		asserted   bool
+	}{
+		// a bypassed request must not carry the header to the service
+		{"192.0.2.1:1234", "/public/", true, false},
+		{"10.1.2.3:1234", "/public/", true, true},
+		// nor may it log the client in
+		{"192.0.2.1:1234", "/app/", false, false},
+	}
+
+	for _, test := range tests {
+		passed, asserted = false, nil
+
+		req := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("X-Forwarded-User", "admin")
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if passed != test.passed || (len(asserted) > 0) != test.asserted {
+			t.Errorf("%s from %s: passed %t with header %v (responded %d), want passed %t and header %t",
+				test.path, test.remoteAddr, passed, asserted, rw.Code, test.passed, test.asserted)
+		}
+
+		if !test.passed && len(rw.Result().Cookies()) > 0 {
+			t.Errorf("%s from %s: a session cookie was set", test.path, test.remoteAddr)
+		}
+	}
+}
+
+func TestTrustedPeer(t *testing.T) {
+	proxyCert := &x509.Certificate{Raw: []byte("proxy certificate")}
+	otherCert := &x509.Certificate{Raw: []byte("other certificate")}
+	fingerprint := sha256.Sum256(proxyCert.Raw)
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.TrustedHeader = "X-Forwarded-User"
+	c.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	c.TrustedProxyCert = hex.EncodeToString(fingerprint[:])
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		cert       *x509.Certificate
+		trusted    bool
+	}{
+		{"10.1.2.3:1234", nil, true},
+		{"[2001:db8::1]:1234", nil, true},
+		{"[2001:db8::2]:1234", nil, false},
+		{"192.0.2.1:1234", nil, false},
+		{"192.0.2.1:1234", proxyCert, true},
+		{"192.0.2.1:1234", otherCert, false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+
+		if got := c.trustedPeer(req); got != test.trusted {
+			t.Errorf("peer %s with certificate %t trusted %t, want %t", test.remoteAddr, test.cert != nil, got, test.trusted)
+		}
+	}
+}
+
+func TestTrustedProxyOptions(t *testing.T) {
+	tests := []func(c *Config){
+		func(c *Config) { c.TrustedHeader = "X-Forwarded-User" },
+		func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/8"} },
+		func(c *Config) { c.TrustedHeader, c.TrustedProxies = "X-Forwarded-User", []string{"10.0.0.0/33"} },
+		func(c *Config) { c.TrustedHeader, c.TrustedProxyCert = "X-Forwarded-User", "abcd" },
+	}
+
+	for idx, apply := range tests {
+		c := CreateConfig()
+		c.Domain = "example.com"
+		apply(c)
+
+		if err := c.Validate(); err == nil {
+			t.Errorf("options %d were accepted", idx)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package trauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// radius packet codes (RFC 2865).
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+)
+
+// radius attribute types.
+const (
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFilterID             = 11
+	radiusReplyMessage         = 18
+	radiusState                = 24
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+)
+
+const (
+	radiusMaxPacket = 4096
+	// radiusMaxValue is the longest value an attribute can hold.
+	radiusMaxValue = 253
+	// radiusChallengeTimeout is how long a user has to answer a challenge.
+	radiusChallengeTimeout = 2 * time.Minute
+)
+
+// errInvalidCredentials is returned when a username and password are
+// not accepted.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// radiusChallenge is returned when a server wants more than a password,
+// such as the code of a hardware token. It is answered on the login page.
+type radiusChallenge struct {
+	id      string
+	message string
+	method  string
+
+	username string
+	state    []byte
+	server   int
+	expires  time.Time
+}
+
+func (rc *radiusChallenge) Error() string {
+	return "radius challenge: " + rc.message
+}
+
+// radiusClient verifies passwords with PAP against a list of servers,
+// trying the next one when a server does not answer in time.
+type radiusClient struct {
+	servers []string
+	secret  []byte
+	timeout time.Duration
+	nasID   string
+
+	// responses without a message authenticator can be forged by
+	// anyone on the path (CVE-2024-3596), so they are refused unless
+	// this is set
+	allowNoMessageAuth bool
+
+	mu      sync.Mutex
+	pending map[string]*radiusChallenge
+}
+
+func newRADIUSClient(c *Config) (*radiusClient, error) {
+
+	if c.RadiusSecret == "" {
+		return nil, fmt.Errorf("radiussecret is required with radiusservers")
+	}
+
+	rc := &radiusClient{
+		secret:  []byte(c.RadiusSecret),
+		timeout: time.Duration(c.RadiusTimeout) * time.Second,
+		nasID:   c.RadiusNASIdentifier,
+		pending: make(map[string]*radiusChallenge),
+
+		allowNoMessageAuth: c.RadiusAllowNoMessageAuth,
+	}
+
+	if rc.timeout <= 0 {
+		rc.timeout = 3 * time.Second
+	}
+
+	if len(rc.nasID) > radiusMaxValue {
+		return nil, fmt.Errorf("radiusnasidentifier can not be longer than %d bytes", radiusMaxValue)
+	}
+
+	for _, server := range c.RadiusServers {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "1812")
+		}
+
+		rc.servers = append(rc.servers, server)
+	}
+
+	return rc, nil
+}
+
+// authenticate sends an Access-Request for a user, returning the groups
+// from the Filter-Id attributes of an Access-Accept. A *radiusChallenge
+// is returned for an Access-Challenge.
+func (rc *radiusClient) authenticate(user, pass string) ([]string, error) {
+
+	if user == "" || pass == "" {
+		return nil, errInvalidCredentials
+	}
+
+	return rc.exchange(user, pass, nil, 0)
+}
+
+// answer continues a challenge with the user's response to it.
+func (rc *radiusClient) answer(challenge *radiusChallenge, response string) ([]string, error) {
+
+	if response == "" {
+		return nil, errInvalidCredentials
+	}
+
+	return rc.exchange(challenge.username, response, challenge.state, challenge.server)
+}
+
+// exchange sends a request to the servers in turn, starting with first,
+// until one of them answers.
+func (rc *radiusClient) exchange(user, pass string, state []byte, first int) ([]string, error) {
+
+	// values that do not fit in an attribute would make a request that
+	// no server answers
+	if len(user) > radiusMaxValue || len(state) > radiusMaxValue {
+		return nil, errInvalidCredentials
+	}
+
+	var lastErr error
+	for i := range rc.servers {
+		idx := (first + i) % len(rc.servers)
+
+		code, attrs, err := rc.send(rc.servers[idx], user, pass, state)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch code {
+		case radiusAccessAccept:
+			var groups []string
+			for _, v := range attrs[radiusFilterID] {
+				groups = append(groups, string(v))
+			}
+
+			return groups, nil
+		case radiusAccessChallenge:
+			challenge := &radiusChallenge{username: user, server: idx}
+			if s := attrs[radiusState]; len(s) > 0 {
+				challenge.state = s[0]
+			}
+
+			var messages []string
+			for _, m := range attrs[radiusReplyMessage] {
+				messages = append(messages, string(m))
+			}
+
+			challenge.message = strings.Join(messages, " ")
+
+			return nil, challenge
+		case radiusAccessReject:
+			return nil, errInvalidCredentials
+		}
+
+		return nil, fmt.Errorf("unexpected radius response code %d from %s", code, rc.servers[idx])
+	}
+
+	return nil, fmt.Errorf("no radius server answered, last error: %s", lastErr)
+}
+
+// send makes a single Access-Request to a server, returning the code and
+// attributes of its response.
+func (rc *radiusClient) send(server, user, pass string, state []byte) (byte, map[byte][][]byte, error) {
+
+	var authenticator [16]byte
+	if _, err := rand.Read(authenticator[:]); err != nil {
+		return 0, nil, err
+	}
+
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, nil, err
+	}
+
+	var attrs bytes.Buffer
+	writeAttr := func(typ byte, value []byte) {
+		attrs.WriteByte(typ)
+		attrs.WriteByte(byte(len(value) + 2))
+		attrs.Write(value)
+	}
+
+	// the message authenticator comes first so that its offset is known
+	writeAttr(radiusMessageAuthenticator, make([]byte, md5.Size))
+	writeAttr(radiusUserName, []byte(user))
+	writeAttr(radiusUserPassword, rc.hidePassword(pass, authenticator[:]))
+	writeAttr(radiusNASIdentifier, []byte(rc.nasID))
+	if state != nil {
+		writeAttr(radiusState, state)
+	}
+
+	packet := make([]byte, 20, 20+attrs.Len())
+	packet[0] = radiusAccessRequest
+	packet[1] = id[0]
+	copy(packet[4:20], authenticator[:])
+	packet = append(packet, attrs.Bytes()...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+
+	mac := hmac.New(md5.New, rc.secret)
+	mac.Write(packet)
+	copy(packet[22:38], mac.Sum(nil))
+
+	conn, err := net.DialTimeout("udp", server, rc.timeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(rc.timeout)); err != nil {
+		return 0, nil, err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return 0, nil, err
+	}
+
+	buf := make([]byte, radiusMaxPacket)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// anything that does not verify is ignored, as if it was lost
+		if code, attrs, ok := rc.parseResponse(buf[:n], id[0], authenticator[:]); ok {
+			return code, attrs, nil
+		}
+	}
+}
+
+// hidePassword encrypts a User-Password attribute (RFC 2865 5.2).
+func (rc *radiusClient) hidePassword(pass string, authenticator []byte) []byte {
+
+	p := []byte(pass)
+	if len(p) > 128 {
+		p = p[:128]
+	}
+
+	if rem := len(p) % 16; rem != 0 || len(p) == 0 {
+		p = append(p, make([]byte, 16-rem)...)
+	}
+
+	out := make([]byte, len(p))
+	prev := authenticator
+	for i := 0; i < len(p); i += 16 {
+		b := md5.Sum(append(append([]byte(nil), rc.secret...), prev...))
+		for j := 0; j < 16; j++ {
+			out[i+j] = p[i+j] ^ b[j]
+		}
+
+		prev = out[i : i+16]
+	}
+
+	return out
+}
+
+// parseResponse verifies a response to a request, returning its code
+// and attributes.
+func (rc *radiusClient) parseResponse(b []byte, id byte, requestAuth []byte) (byte, map[byte][][]byte, bool) {
+
+	if len(b) < 20 || b[1] != id {
+		return 0, nil, false
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 20 || length > len(b) {
+		return 0, nil, false
+	}
+
+	b = b[:length]
+
+	// the response authenticator is md5(code+id+length+request auth+attributes+secret)
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(requestAuth)
+	h.Write(b[20:])
+	h.Write(rc.secret)
+	if !hmac.Equal(h.Sum(nil), b[4:20]) {
+		return 0, nil, false
+	}
+
+	attrs := make(map[byte][][]byte)
+	msgAuth := -1
+	for off := 20; off < len(b); {
+		if off+2 > len(b) || b[off+1] < 2 || off+int(b[off+1]) > len(b) {
+			return 0, nil, false
+		}
+
+		typ, l := b[off], int(b[off+1])
+		if typ == radiusMessageAuthenticator {
+			msgAuth = off + 2
+		}
+
+		attrs[typ] = append(attrs[typ], b[off+2:off+l])
+		off += l
+	}
+
+	if msgAuth == -1 && !rc.allowNoMessageAuth {
+		return 0, nil, false
+	}
+
+	// a message authenticator must be valid if present, computed with
+	// the request authenticator in place of the response one
+	if msgAuth != -1 {
+		if msgAuth+md5.Size > len(b) {
+			return 0, nil, false
+		}
+
+		check := append([]byte(nil), b...)
+		copy(check[4:20], requestAuth)
+		copy(check[msgAuth:msgAuth+md5.Size], make([]byte, md5.Size))
+
+		mac := hmac.New(md5.New, rc.secret)
+		mac.Write(check)
+		if !hmac.Equal(mac.Sum(nil), b[msgAuth:msgAuth+md5.Size]) {
+			return 0, nil, false
+		}
+	}
+
+	return b[0], attrs, true
+}
+
+// hold keeps a challenge until the user answers it on the login page,
+// giving it an id to refer to it by.
+func (rc *radiusClient) hold(challenge *radiusChallenge) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	for id, p := range rc.pending {
+		if now.After(p.expires) {
+			delete(rc.pending, id)
+		}
+	}
+
+	challenge.id = b64url.EncodeToString(securecookie.GenerateRandomKey(32))
+	challenge.expires = now.Add(radiusChallengeTimeout)
+	rc.pending[challenge.id] = challenge
+}
+
+// take returns a held challenge. Each one can be answered once.
+func (rc *radiusClient) take(id string) (*radiusChallenge, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	challenge, ok := rc.pending[id]
+	if !ok {
+		return nil, false
+	}
+
+	delete(rc.pending, id)
+
+	return challenge, time.Now().Before(challenge.expires)
+}
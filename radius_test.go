@@ -0,0 +1,491 @@
+package trauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const radiusTestSecret = `testing123`
+
+// radiusTestReply is what a test responder answers a request with.
+type radiusTestReply struct {
+	code  byte
+	attrs [][2][]byte
+
+	// sign the response with another secret, corrupt its message
+	// authenticator or leave it out
+	secret         []byte
+	badMessageAuth bool
+	noMessageAuth  bool
+}
+
+// radiusTestResponder is a RADIUS server on a local UDP socket, passing
+// each verified request to its handler.
+type radiusTestResponder struct {
+	conn     net.PacketConn
+	secret   []byte
+	requests int32
+	handler  func(user, pass string, state []byte) radiusTestReply
+}
+
+func newRADIUSTestResponder(t *testing.T, secret string, handler func(user, pass string, state []byte) radiusTestReply) *radiusTestResponder {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &radiusTestResponder{conn: conn, secret: []byte(secret), handler: handler}
+	t.Cleanup(func() { conn.Close() })
+
+	go r.serve(t)
+
+	return r
+}
+
+func (r *radiusTestResponder) addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *radiusTestResponder) serve(t *testing.T) {
+	buf := make([]byte, radiusMaxPacket)
+	for {
+		n, peer, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		atomic.AddInt32(&r.requests, 1)
+
+		req := append([]byte(nil), buf[:n]...)
+		attrs, ok := r.verifyRequest(req)
+		if !ok {
+			t.Errorf("request with an invalid message authenticator")
+			continue
+		}
+
+		var state []byte
+		if s := attrs[radiusState]; len(s) > 0 {
+			state = s[0]
+		}
+
+		reply := r.handler(string(attrs[radiusUserName][0]),
+			r.revealPassword(attrs[radiusUserPassword][0], req[4:20]), state)
+
+		_, _ = r.conn.WriteTo(r.response(req, reply), peer)
+	}
+}
+
+// verifyRequest checks the message authenticator of a request and
+// returns its attributes.
+func (r *radiusTestResponder) verifyRequest(b []byte) (map[byte][][]byte, bool) {
+	attrs := make(map[byte][][]byte)
+	msgAuth := -1
+	for off := 20; off+2 <= len(b); off += int(b[off+1]) {
+		if b[off+1] < 2 {
+			return nil, false
+		}
+
+		if b[off] == radiusMessageAuthenticator {
+			msgAuth = off + 2
+		}
+
+		attrs[b[off]] = append(attrs[b[off]], b[off+2:off+int(b[off+1])])
+	}
+
+	if msgAuth == -1 {
+		return nil, false
+	}
+
+	check := append([]byte(nil), b...)
+	copy(check[msgAuth:msgAuth+md5.Size], make([]byte, md5.Size))
+
+	mac := hmac.New(md5.New, r.secret)
+	mac.Write(check)
+
+	return attrs, hmac.Equal(mac.Sum(nil), b[msgAuth:msgAuth+md5.Size])
+}
+
+func (r *radiusTestResponder) revealPassword(hidden, authenticator []byte) string {
+	out := make([]byte, len(hidden))
+	prev := authenticator
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		b := md5.Sum(append(append([]byte(nil), r.secret...), prev...))
+		for j := 0; j < 16; j++ {
+			out[i+j] = hidden[i+j] ^ b[j]
+		}
+
+		prev = hidden[i : i+16]
+	}
+
+	return string(bytes.TrimRight(out, "\x00"))
+}
+
+// response builds a signed response to a request.
+func (r *radiusTestResponder) response(req []byte, reply radiusTestReply) []byte {
+	var attrs bytes.Buffer
+	if !reply.noMessageAuth {
+		attrs.Write([]byte{radiusMessageAuthenticator, 18})
+		attrs.Write(make([]byte, md5.Size))
+	}
+	for _, a := range reply.attrs {
+		attrs.WriteByte(a[0][0])
+		attrs.WriteByte(byte(len(a[1]) + 2))
+		attrs.Write(a[1])
+	}
+
+	packet := make([]byte, 20, 20+attrs.Len())
+	packet[0] = reply.code
+	packet[1] = req[1]
+	copy(packet[4:20], req[4:20])
+	packet = append(packet, attrs.Bytes()...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+
+	secret := r.secret
+	if reply.secret != nil {
+		secret = reply.secret
+	}
+
+	if !reply.noMessageAuth {
+		mac := hmac.New(md5.New, secret)
+		mac.Write(packet)
+		copy(packet[22:38], mac.Sum(nil))
+		if reply.badMessageAuth {
+			packet[22] ^= 0xff
+		}
+	}
+
+	h := md5.New()
+	h.Write(packet)
+	h.Write(secret)
+	copy(packet[4:20], h.Sum(nil))
+
+	return packet
+}
+
+func radiusTestAttr(typ byte, value string) [2][]byte {
+	return [2][]byte{{typ}, []byte(value)}
+}
+
+// radiusTestOTP accepts alice with her password after a challenge for a code.
+func radiusTestOTP(user, pass string, state []byte) radiusTestReply {
+	switch {
+	case user == "alice" && pass == "alicepass" && state == nil:
+		return radiusTestReply{code: radiusAccessChallenge, attrs: [][2][]byte{
+			radiusTestAttr(radiusReplyMessage, "Enter your token code"),
+			radiusTestAttr(radiusState, "state-1"),
+		}}
+	case user == "alice" && pass == "123456" && string(state) == "state-1":
+		return radiusTestReply{code: radiusAccessAccept, attrs: [][2][]byte{
+			radiusTestAttr(radiusFilterID, "vpn"),
+		}}
+	case user == "bob" && pass == "bobpass":
+		return radiusTestReply{code: radiusAccessAccept, attrs: [][2][]byte{
+			radiusTestAttr(radiusFilterID, "staff"),
+			radiusTestAttr(radiusFilterID, "ops"),
+		}}
+	}
+
+	return radiusTestReply{code: radiusAccessReject}
+}
+
+func newRADIUSTestClient(t *testing.T, servers ...string) *radiusClient {
+	t.Helper()
+
+	c := CreateConfig()
+	c.RadiusServers = servers
+	c.RadiusSecret = radiusTestSecret
+
+	rc, err := newRADIUSClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc.timeout = 200 * time.Millisecond
+
+	return rc
+}
+
+func TestRADIUSAccept(t *testing.T) {
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+	rc := newRADIUSTestClient(t, r.addr())
+
+	groups, err := rc.authenticate("bob", "bobpass")
+	if err != nil {
+		t.Fatalf("authenticate: %s", err)
+	}
+
+	if want := []string{"staff", "ops"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+}
+
+func TestRADIUSReject(t *testing.T) {
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+	rc := newRADIUSTestClient(t, r.addr())
+
+	if _, err := rc.authenticate("bob", "wrong"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("authenticate error = %v, want errInvalidCredentials", err)
+	}
+}
+
+func TestRADIUSChallenge(t *testing.T) {
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+	rc := newRADIUSTestClient(t, r.addr())
+
+	_, err := rc.authenticate("alice", "alicepass")
+
+	var challenge *radiusChallenge
+	if !errors.As(err, &challenge) {
+		t.Fatalf("authenticate error = %v, want a challenge", err)
+	}
+
+	if challenge.message != "Enter your token code" || string(challenge.state) != "state-1" {
+		t.Errorf("challenge = %q with state %q", challenge.message, challenge.state)
+	}
+
+	if _, err := rc.answer(challenge, "000000"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("wrong answer error = %v, want errInvalidCredentials", err)
+	}
+
+	groups, err := rc.answer(challenge, "123456")
+	if err != nil {
+		t.Fatalf("answer: %s", err)
+	}
+
+	if want := []string{"vpn"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+}
+
+func TestRADIUSFailover(t *testing.T) {
+	// a server that never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+	rc := newRADIUSTestClient(t, silent.LocalAddr().String(), r.addr())
+
+	if _, err := rc.authenticate("bob", "bobpass"); err != nil {
+		t.Fatalf("authenticate: %s", err)
+	}
+
+	// challenges are answered by the server that sent them
+	_, err = rc.authenticate("alice", "alicepass")
+
+	var challenge *radiusChallenge
+	if !errors.As(err, &challenge) || challenge.server != 1 {
+		t.Fatalf("authenticate error = %v, want a challenge from the second server", err)
+	}
+
+	before := atomic.LoadInt32(&r.requests)
+	if _, err := rc.answer(challenge, "123456"); err != nil {
+		t.Fatalf("answer: %s", err)
+	}
+
+	if atomic.LoadInt32(&r.requests) != before+1 {
+		t.Errorf("answer was not sent to the second server first")
+	}
+}
+
+func TestRADIUSResponseVerification(t *testing.T) {
+	wrongSecret := newRADIUSTestResponder(t, radiusTestSecret, func(string, string, []byte) radiusTestReply {
+		return radiusTestReply{code: radiusAccessAccept, secret: []byte("not-the-secret")}
+	})
+
+	badMessageAuth := newRADIUSTestResponder(t, radiusTestSecret, func(string, string, []byte) radiusTestReply {
+		return radiusTestReply{code: radiusAccessAccept, badMessageAuth: true}
+	})
+
+	for name, addr := range map[string]string{
+		"response authenticator": wrongSecret.addr(),
+		"message authenticator":  badMessageAuth.addr(),
+	} {
+		rc := newRADIUSTestClient(t, addr)
+		if _, err := rc.authenticate("bob", "bobpass"); err == nil || errors.Is(err, errInvalidCredentials) {
+			t.Errorf("%s: authenticate error = %v, want no answer", name, err)
+		}
+	}
+}
+
+func TestRADIUSMissingMessageAuthenticator(t *testing.T) {
+	for _, code := range []byte{radiusAccessAccept, radiusAccessChallenge} {
+		r := newRADIUSTestResponder(t, radiusTestSecret, func(string, string, []byte) radiusTestReply {
+			return radiusTestReply{code: code, noMessageAuth: true, attrs: [][2][]byte{radiusTestAttr(radiusState, "state")}}
+		})
+
+		rc := newRADIUSTestClient(t, r.addr())
+		if _, err := rc.authenticate("bob", "bobpass"); err == nil || errors.Is(err, errInvalidCredentials) {
+			t.Errorf("code %d: authenticate error = %v, want no answer", code, err)
+		}
+
+		var challenge *radiusChallenge
+		rc.allowNoMessageAuth = true
+		if _, err := rc.authenticate("bob", "bobpass"); (code == radiusAccessAccept && err != nil) ||
+			(code == radiusAccessChallenge && !errors.As(err, &challenge)) {
+			t.Errorf("code %d with radiusallownomessageauth: authenticate error = %v", code, err)
+		}
+	}
+}
+
+func TestRADIUSLongValues(t *testing.T) {
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+	rc := newRADIUSTestClient(t, r.addr())
+
+	if _, err := rc.authenticate(strings.Repeat("a", 254), "pass"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("authenticate error = %v, want errInvalidCredentials", err)
+	}
+
+	if _, err := rc.answer(&radiusChallenge{username: "alice", state: make([]byte, 254)}, "123456"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("answer error = %v, want errInvalidCredentials", err)
+	}
+
+	if n := atomic.LoadInt32(&r.requests); n != 0 {
+		t.Errorf("%d requests were sent to the server", n)
+	}
+}
+
+// newRADIUSTestTrauth returns a trauth instance checking passwords
+// against a test responder.
+func newRADIUSTestTrauth(t *testing.T) *Trauth {
+	t.Helper()
+
+	r := newRADIUSTestResponder(t, radiusTestSecret, radiusTestOTP)
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.RadiusServers = []string{r.addr()}
+	c.RadiusSecret = radiusTestSecret
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := handler.(*Trauth)
+	tr.config.radius.timeout = 200 * time.Millisecond
+
+	return tr
+}
+
+// postLoginForm fetches the login page for its csrf cookie, then posts
+// the form with it.
+func postLoginForm(t *testing.T, tr *Trauth, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	page := httptest.NewRecorder()
+	tr.ServeHTTP(page, httptest.NewRequest("GET", "http://example.com"+loginPath, nil))
+
+	cookies := page.Result().Cookies()
+	for _, cookie := range cookies {
+		if cookie.Name == tr.config.csrfCookieName() && form.Get("csrf") == "" {
+			form.Set("csrf", cookie.Value)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com"+loginPasswordPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rw := httptest.NewRecorder()
+	tr.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestRADIUSChallengeOnLoginForm(t *testing.T) {
+	tr := newRADIUSTestTrauth(t)
+
+	rw := postLoginForm(t, tr, url.Values{"username": {"alice"}, "password": {"alicepass"}})
+	if rw.Code != http.StatusUnauthorized || !strings.Contains(rw.Body.String(), "Enter your token code") {
+		t.Fatalf("login form responded %d without the challenge", rw.Code)
+	}
+
+	if len(tr.config.radius.pending) != 1 {
+		t.Fatalf("%d challenges held, want 1", len(tr.config.radius.pending))
+	}
+
+	var id string
+	for id = range tr.config.radius.pending {
+	}
+
+	rw = postLoginForm(t, tr, url.Values{"challenge": {id}, "response": {"123456"}})
+	if rw.Code != http.StatusSeeOther {
+		t.Errorf("challenge answer responded %d, want %d", rw.Code, http.StatusSeeOther)
+	}
+}
+
+func TestRADIUSChallengeNotHeldForBasic(t *testing.T) {
+	tr := newRADIUSTestTrauth(t)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.SetBasicAuth("alice", "alicepass")
+
+	rw := httptest.NewRecorder()
+	tr.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("basic login with a challenge responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	if n := len(tr.config.radius.pending); n != 0 {
+		t.Errorf("%d challenges held for a basic login", n)
+	}
+}
+
+func TestLoginFormCSRF(t *testing.T) {
+	tr := newRADIUSTestTrauth(t)
+
+	rw := postLoginForm(t, tr, url.Values{"username": {"bob"}, "password": {"bobpass"}, "csrf": {"forged"}})
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("login with a forged csrf token responded %d, want %d", rw.Code, http.StatusForbidden)
+	}
+
+	rw = postLoginForm(t, tr, url.Values{"username": {"bob"}, "password": {"bobpass"}})
+	if rw.Code != http.StatusSeeOther {
+		t.Errorf("login responded %d, want %d", rw.Code, http.StatusSeeOther)
+	}
+}
+
+func TestLoginFormHtpasswdOnly(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Users = "admin:$2y$05$glPGlcTOC.VMrpmK.ccmZeCiqyDYE96t7aUGCqmb8tuKXq6yoPzeG"
+
+	passed := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { passed = true })
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com"+loginPasswordPath, strings.NewReader("username=admin&password=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if passed || rw.Code != http.StatusUnauthorized || rw.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("login form was served without a login page, responded %d", rw.Code)
+	}
+}
@@ -0,0 +1,149 @@
+package trauth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneSize is the number of tracked clients after which idle
+// buckets are dropped.
+const rateLimitPruneSize = 10000
+
+// RateLimit configures a token bucket for the requests matching a rule.
+//
+// Average requests are allowed per Period seconds, with short bursts
+// of up to Burst requests. Limits are kept per username when the
+// request is authenticated, and per client IP otherwise.
+type RateLimit struct {
+	Average int `yaml:"average"`
+	Period  int `yaml:"period"`
+	Burst   int `yaml:"burst"`
+}
+
+// bucket is the token bucket of a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps the buckets for one rule.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+// compile validates the limit and prepares its limiter.
+func (rl *RateLimit) compile(domain string) (*rateLimiter, error) {
+
+	if rl.Average <= 0 {
+		return nil, fmt.Errorf("ratelimit for domain %s needs a positive average", domain)
+	}
+
+	if rl.Period <= 0 {
+		rl.Period = 1
+	}
+
+	if rl.Burst <= 0 {
+		rl.Burst = rl.Average
+	}
+
+	return &rateLimiter{
+		rate:    float64(rl.Average) / float64(rl.Period),
+		burst:   float64(rl.Burst),
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// take removes a token from the bucket for key. It returns if the
+// request is allowed, the tokens that remain and how long it will take
+// for the next token (when none remain) or the bucket (otherwise) to fill.
+func (l *rateLimiter) take(key string) (bool, int, time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if len(l.buckets) >= rateLimitPruneSize {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	reset := time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second))
+
+	return true, int(b.tokens), reset
+}
+
+// prune drops the buckets that would have filled up again by now.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// newLoginLimiter limits the attempts clients can make at the login form.
+func newLoginLimiter() *rateLimiter {
+	limiter, _ := (&RateLimit{Average: loginAttempts, Period: 60}).compile("")
+	return limiter
+}
+
+// seconds rounds a duration up to whole seconds for headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimited applies the rate limit of a rule to a request, writing a 429
+// response and returning true if the request is over the limit.
+func (t *Trauth) rateLimited(rw http.ResponseWriter, req *http.Request, rule *Rule, user User) bool {
+
+	if rule == nil || rule.limiter == nil {
+		return false
+	}
+
+	key := "ip:" + req.RemoteAddr
+	if ip := clientIP(req); ip != nil {
+		key = "ip:" + ip.String()
+	}
+
+	if user.Authenticated {
+		key = "user:" + user.Username
+	}
+
+	allowed, remaining, reset := rule.limiter.take(key)
+
+	rw.Header().Set("RateLimit-Limit", strconv.Itoa(rule.RateLimit.Burst))
+	rw.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	rw.Header().Set("RateLimit-Reset", seconds(reset))
+
+	if allowed {
+		return false
+	}
+
+	t.logger.Printf("rate limited %s for %s%s", key, req.Host, req.URL.Path)
+	rw.Header().Set("Retry-After", seconds(reset))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+	return true
+}
@@ -0,0 +1,108 @@
+package trauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	limiter, err := (&RateLimit{Average: 2, Period: 60, Burst: 3}).compile("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i >= 0; i-- {
+		allowed, remaining, _ := limiter.take("alice")
+		if !allowed || remaining != i {
+			t.Fatalf("request allowed %t with %d remaining, want %d remaining", allowed, remaining, i)
+		}
+	}
+
+	allowed, _, wait := limiter.take("alice")
+	if allowed {
+		t.Fatalf("request over the burst was allowed")
+	}
+
+	// a token is added every 30 seconds
+	if wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("next token in %s, want 30s", wait)
+	}
+
+	if allowed, _, _ := limiter.take("bob"); !allowed {
+		t.Errorf("request for another key was limited")
+	}
+
+	// a minute later, two tokens have been added
+	limiter.buckets["alice"].last = time.Now().Add(-time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := limiter.take("alice"); !allowed {
+			t.Errorf("request %d after refilling was limited", i)
+		}
+	}
+
+	if allowed, _, _ := limiter.take("alice"); allowed {
+		t.Errorf("request over the refilled tokens was allowed")
+	}
+
+	// the bucket does not fill past the burst
+	limiter.buckets["alice"].last = time.Now().Add(-time.Hour)
+
+	if _, remaining, _ := limiter.take("alice"); remaining != 2 {
+		t.Errorf("%d tokens remaining after an hour, want 2", remaining)
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Rules = []Rule{{
+		Domain:    "example.com",
+		Action:    actionAllow,
+		Excludes:  []Exclude{{PathPrefix: "/api/"}},
+		RateLimit: RateLimit{Average: 2, Period: 60},
+	}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api/status", nil)
+		req.RemoteAddr = remoteAddr
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := request("192.0.2.1:1234"); rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Limit") != "2" {
+			t.Fatalf("request %d responded %d with RateLimit-Limit %q", i, rw.Code, rw.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	// the port of the client does not give it a new bucket
+	rw := request("192.0.2.1:5678")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit responded %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+
+	if got := rw.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After is %q, want 30", got)
+	}
+
+	if got := rw.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining is %q, want 0", got)
+	}
+
+	if rw := request("192.0.2.2:1234"); rw.Code != http.StatusOK {
+		t.Errorf("request from another client responded %d, want %d", rw.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,54 @@
+package trauth
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often files that are hot-reloaded are checked
+// for changes.
+const reloadInterval = 30 * time.Second
+
+// watchedFile tracks the modification time of a file so that callers
+// can reload it when it changes. Checks are done lazily, at most once
+// every reloadInterval.
+type watchedFile struct {
+	path string
+
+	mu        sync.Mutex
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newWatchedFile(path string) *watchedFile {
+	wf := &watchedFile{path: path, lastCheck: time.Now()}
+	if info, err := os.Stat(path); err == nil {
+		wf.modTime = info.ModTime()
+	}
+
+	return wf
+}
+
+// changed reports if the file was modified since the last time
+// changed returned true, or since the watch started.
+func (wf *watchedFile) changed() bool {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(wf.lastCheck) < reloadInterval {
+		return false
+	}
+
+	wf.lastCheck = now
+
+	info, err := os.Stat(wf.path)
+	if err != nil || info.ModTime().Equal(wf.modTime) {
+		return false
+	}
+
+	wf.modTime = info.ModTime()
+
+	return true
+}
@@ -1,54 +1,570 @@
 package trauth
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// Values for the match option of an exclude.
+const (
+	matchAny = `any`
+	matchAll = `all`
+)
+
+// Exclude defines the conditions under which a request skips
+// authentication.
+//
+// Every configured option is a condition. Match decides if any or all
+// of them need to be true for the exclude to apply. It defaults to all
+// when a method, header, query or scheme condition is set, as those
+// only narrow down the requests the other conditions match, and to any
+// otherwise.
 type Exclude struct {
-	Path  string `yaml:"path"`
-	IPNet string `yaml:"ipnet"`
+	Path       string           `yaml:"path"`
+	PathPrefix string           `yaml:"pathprefix"`
+	Glob       string           `yaml:"glob"`
+	IPNet      string           `yaml:"ipnet"`
+	IPNetFile  string           `yaml:"ipnetfile"`
+	IPSet      string           `yaml:"ipset"`
+	Methods    []string         `yaml:"methods"`
+	Headers    []ValueCondition `yaml:"headers"`
+	Query      []ValueCondition `yaml:"query"`
+	Scheme     string           `yaml:"scheme"`
+	Countries  []string         `yaml:"countries"`
+	ASNs       []uint           `yaml:"asns"`
+	Match      string           `yaml:"match"`
 
 	// "computed" values from configuration parsing
 	regexPath *regexp.Regexp
+	globPath  *globPattern
 	ipNet     *net.IPNet
+	fileList  *ipList
+	setList   *ipList
 }
 
-// Rule defines a trauth rule to exclude authentication
-type Rule struct {
-	Domain   string    `yaml:"domain"`
-	Excludes []Exclude `yaml:"excludes"`
+// ValueCondition matches a named request header or query parameter.
+// With an empty Value, the name only has to be present. Otherwise,
+// Value is a regular expression that one of its values has to match.
+type ValueCondition struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+
+	regexValue *regexp.Regexp
 }
 
-func skipViaRule(rules []Rule, req *http.Request) bool {
-	for _, rule := range rules {
+// compile validates an exclude and prepares its conditions.
+func (e *Exclude) compile(domain string) error {
 
-		// skip processing rules for domains that dont match
-		if req.Host != rule.Domain {
-			continue
+	if e.IPNet != "" {
+		_, subnet, err := net.ParseCIDR(e.IPNet)
+		if err != nil {
+			return fmt.Errorf("failed to parse source ip range '%s' for domain %s with error %s",
+				e.IPNet, domain, err)
+		}
+
+		e.ipNet = subnet
+	}
+
+	if e.Path != "" {
+		rex, err := regexp.Compile(e.Path)
+		if err != nil {
+			return fmt.Errorf("failed to compile rule regex '%s' for domain %s", e.Path, domain)
+		}
+
+		// assign the compiled regex to the struct
+		e.regexPath = rex
+	}
+
+	if e.PathPrefix != "" && !strings.HasPrefix(e.PathPrefix, "/") {
+		return fmt.Errorf("pathprefix '%s' for domain %s must start with a /", e.PathPrefix, domain)
+	}
+
+	if e.Glob != "" {
+		glob, err := compileGlob(e.Glob)
+		if err != nil {
+			return fmt.Errorf("%s for domain %s", err, domain)
+		}
+
+		e.globPath = glob
+	}
+
+	for idx, method := range e.Methods {
+		e.Methods[idx] = strings.ToUpper(strings.TrimSpace(method))
+	}
+
+	for _, conditions := range [][]ValueCondition{e.Headers, e.Query} {
+		for idx, cond := range conditions {
+			if cond.Name == "" {
+				return fmt.Errorf("a header or query condition without a name is set for domain %s", domain)
+			}
+
+			if cond.Value == "" {
+				continue
+			}
+
+			rex, err := regexp.Compile(cond.Value)
+			if err != nil {
+				return fmt.Errorf("failed to compile condition regex '%s' for '%s' on domain %s",
+					cond.Value, cond.Name, domain)
+			}
+
+			conditions[idx].regexValue = rex
+		}
+	}
+
+	for idx, country := range e.Countries {
+		e.Countries[idx] = strings.ToUpper(strings.TrimSpace(country))
+	}
+
+	e.Scheme = strings.ToLower(e.Scheme)
+	if e.Scheme != "" && e.Scheme != "http" && e.Scheme != "https" {
+		return fmt.Errorf("scheme '%s' for domain %s must be http or https", e.Scheme, domain)
+	}
+
+	switch e.Match {
+	case "":
+		e.Match = matchAny
+		if e.narrows() {
+			e.Match = matchAll
+		}
+	case matchAny, matchAll:
+	default:
+		return fmt.Errorf("match '%s' for domain %s must be %s or %s", e.Match, domain, matchAny, matchAll)
+	}
+
+	return nil
+}
+
+// narrows checks if an exclude has conditions that describe what a
+// request looks like rather than where it goes or comes from. Anyone
+// can send a request that satisfies them, so on their own they would
+// skip authentication for the whole host.
+func (e *Exclude) narrows() bool {
+	return len(e.Methods) > 0 || len(e.Headers) > 0 || len(e.Query) > 0 || e.Scheme != ""
+}
+
+// matchValues checks if any of the values satisfies a condition.
+func (vc *ValueCondition) matchValues(values []string) bool {
+	if vc.regexValue == nil {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if vc.regexValue.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// condition is the result of checking one exclude condition.
+type condition struct {
+	name    string
+	matched bool
+}
+
+func (c condition) String() string {
+	return fmt.Sprintf("%s=%t", c.name, c.matched)
+}
+
+// requestInfo holds values derived from a request that rules match
+// against, resolving the more expensive ones only when needed.
+type requestInfo struct {
+	source net.IP
+	path   string
+	geo    *geoDB
+
+	located  bool
+	location geoLocation
+}
+
+func newRequestInfo(req *http.Request, geo *geoDB) *requestInfo {
+	return &requestInfo{source: clientIP(req), path: normalizePath(req.URL.Path), geo: geo}
+}
+
+// locate returns the geoip location of the client.
+func (ri *requestInfo) locate() geoLocation {
+	if !ri.located {
+		ri.location = ri.geo.lookup(ri.source)
+		ri.located = true
+	}
+
+	return ri.location
+}
+
+// evaluate checks each of the conditions of an exclude against a request.
+func (e *Exclude) evaluate(req *http.Request, ri *requestInfo) []condition {
+
+	var results []condition
+	source := ri.source
+
+	// check source ip rules
+	if e.ipNet != nil {
+		results = append(results, condition{"ipnet", source != nil && e.ipNet.Contains(source)})
+	}
+
+	if e.fileList != nil {
+		results = append(results, condition{"ipnetfile", source != nil && e.fileList.contains(source)})
+	}
+
+	if e.setList != nil {
+		results = append(results, condition{"ipset " + e.IPSet, source != nil && e.setList.contains(source)})
+	}
+
+	// check path rules
+	if e.regexPath != nil {
+		results = append(results, condition{"path", e.regexPath.MatchString(ri.path)})
+	}
+
+	if e.PathPrefix != "" {
+		results = append(results, condition{"pathprefix", strings.HasPrefix(ri.path, e.PathPrefix)})
+	}
+
+	if e.globPath != nil {
+		results = append(results, condition{"glob", e.globPath.match(ri.path)})
+	}
+
+	if len(e.Methods) > 0 {
+		matched := false
+		for _, method := range e.Methods {
+			if req.Method == method {
+				matched = true
+				break
+			}
+		}
+
+		results = append(results, condition{"methods", matched})
+	}
+
+	for _, header := range e.Headers {
+		results = append(results, condition{"header " + header.Name,
+			header.matchValues(req.Header.Values(header.Name))})
+	}
+
+	if len(e.Query) > 0 {
+		query := req.URL.Query()
+		for _, param := range e.Query {
+			results = append(results, condition{"query " + param.Name, param.matchValues(query[param.Name])})
 		}
+	}
+
+	if e.Scheme != "" {
+		results = append(results, condition{"scheme", requestScheme(req) == e.Scheme})
+	}
 
-		source := net.ParseIP(strings.Split(req.RemoteAddr, ":")[0])
+	if len(e.Countries) > 0 {
+		country := ri.locate().Country
+		matched := false
+		for _, c := range e.Countries {
+			if country != "" && c == country {
+				matched = true
+				break
+			}
+		}
 
-		for _, exclude := range rule.Excludes {
+		results = append(results, condition{"countries (" + country + ")", matched})
+	}
 
-			// check source ip rules
-			if source != nil && exclude.ipNet != nil {
-				if exclude.ipNet.Contains(source) {
-					return true
-				}
+	if len(e.ASNs) > 0 {
+		asn := ri.locate().ASN
+		matched := false
+		for _, a := range e.ASNs {
+			if asn != 0 && a == asn {
+				matched = true
+				break
 			}
+		}
+
+		results = append(results, condition{fmt.Sprintf("asns (%d)", asn), matched})
+	}
+
+	return results
+}
+
+// combine applies the match mode of an exclude to its condition results.
+func (e *Exclude) combine(results []condition) bool {
+
+	// an exclude without any conditions never applies
+	if len(results) == 0 {
+		return false
+	}
 
-			// check path rules
-			if exclude.regexPath != nil {
-				if exclude.regexPath.MatchString(req.URL.Path) {
-					return true
-				}
+	for _, result := range results {
+		if e.Match == matchAny && result.matched {
+			return true
+		}
+
+		if e.Match == matchAll && !result.matched {
+			return false
+		}
+	}
+
+	return e.Match == matchAll
+}
+
+// matches evaluates the conditions of an exclude against a request.
+func (e *Exclude) matches(req *http.Request, ri *requestInfo) bool {
+	return e.combine(e.evaluate(req, ri))
+}
+
+// Rule actions, taken when one of a rules excludes matches a request.
+const (
+	// actionAllow skips authentication
+	actionAllow = `allow`
+	// actionDeny always refuses the request, even when authenticated
+	actionDeny = `deny`
+	// actionRequire forces authentication, ignoring any later rules
+	actionRequire = `require`
+	// actionAuthorize requires authentication as one of Users or Groups
+	actionAuthorize = `authorize`
+)
+
+// Rule defines a trauth rule to exclude authentication, or take
+// another Action for matching requests.
+//
+// Rules are evaluated in the order they are declared and the first rule
+// with a matching exclude decides what happens to a request.
+//
+// A rule applies to requests for the hosts matched by Domain, which may
+// be an exact hostname, a wildcard such as *.example.com or empty / *
+// for all hosts. DomainRegex can be used instead for more complex host
+// patterns, and has to match the whole host. Ports are ignored when
+// matching hosts.
+type Rule struct {
+	Name        string       `yaml:"name"`
+	Domain      string       `yaml:"domain"`
+	DomainRegex string       `yaml:"domainregex"`
+	Excludes    []Exclude    `yaml:"excludes"`
+	Stateless   bool         `yaml:"stateless"`
+	Action      string       `yaml:"action"`
+	Users       []string     `yaml:"users"`
+	Groups      []string     `yaml:"groups"`
+	Windows     []TimeWindow `yaml:"windows"`
+	AuthMethods []string     `yaml:"authmethods"`
+	RateLimit   RateLimit    `yaml:"ratelimit"`
+	Signature   Signature    `yaml:"signature"`
+
+	// "computed" values from configuration parsing
+	index      int
+	limiter    *rateLimiter
+	verifier   *signatureVerifier
+	anyHost    bool
+	host       string
+	hostSuffix string
+	hostRegex  *regexp.Regexp
+}
+
+// compileHost prepares the host matching for a rule.
+func (r *Rule) compileHost() error {
+
+	if r.DomainRegex != "" {
+		if r.Domain != "" {
+			return fmt.Errorf("both domain '%s' and domainregex '%s' are set on a rule", r.Domain, r.DomainRegex)
+		}
+
+		// anchored so that a pattern for app.example.com does not
+		// also match app.example.com.evil.com
+		rex, err := regexp.Compile(`(?i)^(?:` + r.DomainRegex + `)$`)
+		if err != nil {
+			return fmt.Errorf("failed to compile domainregex '%s' with error %s", r.DomainRegex, err)
+		}
+
+		r.hostRegex = rex
+		return nil
+	}
+
+	// normalized the same way as request hosts are in matchesHost
+	domain := strings.ToLower(strings.TrimSuffix(stripPort(strings.TrimSpace(r.Domain)), "."))
+
+	switch {
+	case domain == "" || domain == "*":
+		r.anyHost = true
+	case strings.HasPrefix(domain, "*."):
+		r.hostSuffix = domain[1:]
+	case strings.Contains(domain, "*"):
+		return fmt.Errorf("domain '%s' may only have a wildcard as its first label", r.Domain)
+	default:
+		r.host = domain
+	}
+
+	return nil
+}
+
+// label names a rule in logs and decision headers.
+func (r *Rule) label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return fmt.Sprintf("rules[%d]", r.index)
+}
+
+// compileAction validates the action of a rule.
+func (r *Rule) compileAction() error {
+
+	r.Action = strings.ToLower(r.Action)
+
+	switch r.Action {
+	case "":
+		r.Action = actionAllow
+	case actionAllow, actionDeny, actionRequire:
+	case actionAuthorize:
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return fmt.Errorf("an authorize rule for domain %s needs users or groups", r.Domain)
+		}
+	default:
+		return fmt.Errorf("unknown action '%s' for domain %s", r.Action, r.Domain)
+	}
+
+	for idx, method := range r.AuthMethods {
+		method = strings.ToLower(strings.TrimSpace(method))
+		if !authMethods[method] {
+			return fmt.Errorf("unknown authentication method '%s' for domain %s", method, r.Domain)
+		}
+
+		r.AuthMethods[idx] = method
+	}
+
+	if r.RateLimit != (RateLimit{}) {
+		if r.Action == actionDeny {
+			return fmt.Errorf("a ratelimit for domain %s can not be used with a deny rule", r.Domain)
+		}
+
+		limiter, err := r.RateLimit.compile(r.Domain)
+		if err != nil {
+			return err
+		}
+
+		r.limiter = limiter
+	}
+
+	if r.Signature != (Signature{}) {
+		if r.Action != actionAllow {
+			return fmt.Errorf("a signature for domain %s can only be used with an allow rule", r.Domain)
+		}
+
+		verifier, err := r.Signature.compile(r.Domain)
+		if err != nil {
+			return err
+		}
+
+		r.verifier = verifier
+	}
+
+	if len(r.AuthMethods) > 0 && r.Action != actionRequire && r.Action != actionAuthorize {
+		return fmt.Errorf("authmethods for domain %s can only be used with require or authorize rules", r.Domain)
+	}
+
+	if r.Stateless && r.Action != actionRequire && r.Action != actionAuthorize {
+		return fmt.Errorf("stateless for domain %s can only be used with require or authorize rules", r.Domain)
+	}
+
+	return nil
+}
+
+// satisfiedBy checks if a session used one of the authentication
+// methods a rule asks for.
+func (r *Rule) satisfiedBy(user User) bool {
+	if len(r.AuthMethods) == 0 {
+		return true
+	}
+
+	for _, method := range r.AuthMethods {
+		if user.hasMethod(method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized checks if a user is allowed by an authorize rule at this time.
+func (r *Rule) authorized(user User) bool {
+	for _, u := range r.Users {
+		if u == user.Username {
+			return r.userInWindow(user, time.Now())
+		}
+	}
+
+	for _, g := range r.Groups {
+		for _, ug := range user.Groups {
+			if g == ug {
+				return r.userInWindow(user, time.Now())
 			}
 		}
 	}
 
 	return false
 }
+
+// matchesHost checks if a request host is covered by the rule.
+func (r *Rule) matchesHost(host string) bool {
+
+	host = strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+
+	switch {
+	case r.anyHost:
+		return true
+	case r.hostRegex != nil:
+		return r.hostRegex.MatchString(host)
+	case r.hostSuffix != "":
+		return strings.HasSuffix(host, r.hostSuffix) && len(host) > len(r.hostSuffix)
+	}
+
+	return host == r.host
+}
+
+// clientIP returns the address of the connecting client.
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// matchRule returns the first rule with an exclude matching the
+// request, or nil if there is none. Each evaluation step is passed to
+// debugf, which is expected to discard it unless debugging is enabled.
+func matchRule(rules []Rule, req *http.Request, ri *requestInfo, debugf func(string, ...interface{})) *Rule {
+
+	now := time.Now()
+	debugf("evaluating %d rules for %s %s%s (normalized %s) from %s (client ip %v)",
+		len(rules), req.Method, req.Host, req.URL.Path, ri.path, req.RemoteAddr, ri.source)
+
+	for idx := range rules {
+		rule := &rules[idx]
+
+		// skip processing rules for domains that dont match
+		if !rule.matchesHost(req.Host) {
+			debugf("%s: host %s does not match", rule.label(), req.Host)
+			continue
+		}
+
+		if !rule.inWindow(now) {
+			debugf("%s: outside of its time windows", rule.label())
+			continue
+		}
+
+		for eidx, exclude := range rule.Excludes {
+			results := exclude.evaluate(req, ri)
+			matched := exclude.combine(results)
+			debugf("%s excludes[%d]: %v (match %s) -> %t", rule.label(), eidx, results, exclude.Match, matched)
+
+			if matched {
+				debugf("%s matched, action %s", rule.label(), rule.Action)
+				return rule
+			}
+		}
+	}
+
+	debugf("no rule matched")
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package trauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatelessRuleScope(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Users = "admin:$2y$05$glPGlcTOC.VMrpmK.ccmZeCiqyDYE96t7aUGCqmb8tuKXq6yoPzeG"
+	c.Rules = []Rule{{
+		Domain:    "example.com",
+		Action:    actionRequire,
+		Stateless: true,
+		Excludes:  []Exclude{{PathPrefix: "/api/"}},
+	}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		session bool
+	}{
+		{"/api/status", false},
+		{"/", true},
+		{"/app/", true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		req.SetBasicAuth("admin", "password")
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if session := len(rw.Result().Cookies()) > 0; session != test.session {
+			t.Errorf("%s: session cookie set %t, want %t", test.path, session, test.session)
+		}
+	}
+}
+
+func TestStatelessRuleAction(t *testing.T) {
+	for _, action := range []string{"", actionAllow, actionDeny} {
+		c := CreateConfig()
+		c.Domain = "example.com"
+		c.Rules = []Rule{{Action: action, Stateless: true, Excludes: []Exclude{{PathPrefix: "/api/"}}}}
+
+		if err := c.Validate(); err == nil {
+			t.Errorf("stateless was accepted on a rule with action %q", action)
+		}
+	}
+}
+
+func TestRuleMatchesHost(t *testing.T) {
+	tests := []struct {
+		domain string
+		regex  string
+		host   string
+		match  bool
+	}{
+		{"app.example.com", "", "app.example.com", true},
+		{"app.example.com", "", "APP.example.com:8443", true},
+		{"app.example.com", "", "app.example.com.", true},
+		{" App.Example.com ", "", "app.example.com", true},
+		{"app.example.com.", "", "app.example.com", true},
+		{"app.example.com:443", "", "app.example.com", true},
+		{"App.Example.com:443", "", "app.example.com:8443", true},
+		{"app.example.com", "", "other.example.com", false},
+		{"app.example.com", "", "app.example.com.evil.com", false},
+		{"*.example.com", "", "app.example.com", true},
+		{"*.example.com.", "", "APP.example.com:443", true},
+		{"*.example.com", "", "example.com", false},
+		{"", "", "anything.example.org", true},
+		{"", `app\.example\.com`, "app.example.com", true},
+		{"", `app\.example\.com`, "APP.example.com:8443", true},
+		{"", `app\.example\.com`, "app.example.com.evil.com", false},
+		{"", `app\.example\.com`, "evilapp.example.com", false},
+		{"", `app\.example\.com|api\.example\.com`, "api.example.com", true},
+		{"", `app\.example\.com|api\.example\.com`, "api.example.com.evil.com", false},
+		{"", `[a-z]+\.example\.com`, "app.example.com", true},
+		{"", `[a-z]+\.example\.com`, "app.example.com.evil.com", false},
+	}
+
+	for _, test := range tests {
+		rule := Rule{Domain: test.domain, DomainRegex: test.regex}
+		if err := rule.compileHost(); err != nil {
+			t.Fatalf("%q: %s", test.domain+test.regex, err)
+		}
+
+		if got := rule.matchesHost(test.host); got != test.match {
+			t.Errorf("domain %q matching host %q = %t, want %t", test.domain+test.regex, test.host, got, test.match)
+		}
+	}
+}
+
+func TestExcludeNarrowingConditions(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Rules = []Rule{
+		{Domain: "example.com", Excludes: []Exclude{{PathPrefix: "/hooks/", Methods: []string{"post"}}}},
+		{Domain: "example.com", Excludes: []Exclude{{PathPrefix: "/public/", Scheme: "https", Match: matchAny}}},
+	}
+
+	passed := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { passed = true })
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		passed bool
+	}{
+		{"POST", "http://example.com/hooks/github", true},
+		{"GET", "http://example.com/hooks/github", false},
+		// a method on its own must not skip authentication for the host
+		{"POST", "http://example.com/admin/delete", false},
+		// unless the exclude asks for any condition to match
+		{"GET", "https://example.com/admin/", true},
+		{"GET", "http://example.com/public/", true},
+		{"GET", "http://example.com/admin/", false},
+	}
+
+	for _, test := range tests {
+		passed = false
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(test.method, test.url, nil))
+
+		if passed != test.passed {
+			t.Errorf("%s %s: passed %t (responded %d), want %t", test.method, test.url, passed, rw.Code, test.passed)
+		}
+	}
+}
+
+func TestRuleActionPrecedence(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Users = "admin:$2y$05$glPGlcTOC.VMrpmK.ccmZeCiqyDYE96t7aUGCqmb8tuKXq6yoPzeG"
+	c.Rules = []Rule{
+		{Domain: "other.example.com", Action: actionAllow, Excludes: []Exclude{{PathPrefix: "/"}}},
+		{Domain: "example.com", Action: actionDeny, Excludes: []Exclude{{PathPrefix: "/public/secret/"}}},
+		{Domain: "example.com", Action: actionAllow, Excludes: []Exclude{{PathPrefix: "/public/"}}},
+		{Domain: "example.com", Action: actionAuthorize, Users: []string{"bob"}, Excludes: []Exclude{{PathPrefix: "/admin/"}}},
+		{Domain: "example.com", Action: actionRequire, Excludes: []Exclude{{PathPrefix: "/app/"}}},
+		{Domain: "example.com", Action: actionAllow, Excludes: []Exclude{{PathPrefix: "/app/open/"}}},
+	}
+
+	passed := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { passed = true })
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url    string
+		login  bool
+		code   int
+		passed bool
+	}{
+		{"http://example.com/public/index.html", false, http.StatusOK, true},
+		// an earlier deny wins over a later allow
+		{"http://example.com/public/secret/keys", false, http.StatusForbidden, false},
+		{"http://example.com/public/secret/keys", true, http.StatusForbidden, false},
+		// a rule for another host does not apply
+		{"http://example.com/", false, http.StatusUnauthorized, false},
+		{"http://other.example.com/", false, http.StatusOK, true},
+		{"http://example.com/admin/", true, http.StatusForbidden, false},
+		// an earlier require wins over a later allow
+		{"http://example.com/app/open/", false, http.StatusUnauthorized, false},
+		{"http://example.com/app/open/", true, http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+		passed = false
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.login {
+			req.SetBasicAuth("admin", "password")
+		}
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		// logging in sets a session and sends the client back to the page
+		if test.login && rw.Code == http.StatusTemporaryRedirect {
+			retry := httptest.NewRequest("GET", test.url, nil)
+			for _, cookie := range rw.Result().Cookies() {
+				retry.AddCookie(cookie)
+			}
+
+			rw = httptest.NewRecorder()
+			handler.ServeHTTP(rw, retry)
+		}
+
+		if rw.Code != test.code || passed != test.passed {
+			t.Errorf("%s (login %t): responded %d and passed %t, want %d and %t",
+				test.url, test.login, rw.Code, passed, test.code, test.passed)
+		}
+	}
+}
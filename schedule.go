@@ -0,0 +1,205 @@
+package trauth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a recurring period of time in which a rule applies.
+//
+// Days limits the window to days of the week (mon, tue, ...), every day
+// if empty. Start and End are times of day in the 24 hour HH:MM format.
+// An End before Start means the window runs past midnight into the next
+// day, and Start and End may not be the same. TimeZone is an IANA time
+// zone name, UTC if empty.
+//
+// On authorize rules, Users and Groups limit the window to those users,
+// for example to only let contractors in during business hours.
+type TimeWindow struct {
+	Days     []string `yaml:"days"`
+	Start    string   `yaml:"start"`
+	End      string   `yaml:"end"`
+	TimeZone string   `yaml:"timezone"`
+	Users    []string `yaml:"users"`
+	Groups   []string `yaml:"groups"`
+
+	// "computed" values from configuration parsing
+	days     map[time.Weekday]bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+// parseClock converts an HH:MM value to minutes since midnight.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", v)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// compile validates a window and prepares it for use.
+func (w *TimeWindow) compile() error {
+
+	var err error
+
+	if w.Start == "" || w.End == "" {
+		return fmt.Errorf("a time window needs both a start and an end")
+	}
+
+	if w.start, err = parseClock(w.Start); err != nil {
+		return err
+	}
+
+	if w.end, err = parseClock(w.End); err != nil {
+		return err
+	}
+
+	// an empty window would never match, and a full day is better
+	// written as 00:00 to 23:59
+	if w.start == w.end {
+		return fmt.Errorf("time window start and end are both %s", w.Start)
+	}
+
+	w.location = time.UTC
+	if w.TimeZone != "" {
+		if w.location, err = time.LoadLocation(w.TimeZone); err != nil {
+			return fmt.Errorf("failed to load time zone '%s' with error %s", w.TimeZone, err)
+		}
+	}
+
+	if len(w.Days) > 0 {
+		w.days = make(map[time.Weekday]bool)
+		for _, d := range w.Days {
+			// accept both short and full day names
+			name := strings.ToLower(strings.TrimSpace(d))
+			if len(name) > 3 {
+				name = name[:3]
+			}
+
+			day, ok := weekdays[name]
+			if !ok {
+				return fmt.Errorf("invalid day of the week '%s'", d)
+			}
+
+			w.days[day] = true
+		}
+	}
+
+	return nil
+}
+
+// onDay checks if the window starts on a day of the week.
+func (w *TimeWindow) onDay(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}
+
+// contains checks if a point in time falls inside the window.
+func (w *TimeWindow) contains(now time.Time) bool {
+
+	now = now.In(w.location)
+	minute := now.Hour()*60 + now.Minute()
+
+	if w.start <= w.end {
+		return w.onDay(now.Weekday()) && minute >= w.start && minute < w.end
+	}
+
+	// the window wraps past midnight. either we are in the part that
+	// started today, or in the part that started yesterday.
+	if w.onDay(now.Weekday()) && minute >= w.start {
+		return true
+	}
+
+	return w.onDay(now.AddDate(0, 0, -1).Weekday()) && minute < w.end
+}
+
+// appliesTo checks if a window limits a user.
+func (w *TimeWindow) appliesTo(user User) bool {
+	if len(w.Users) == 0 && len(w.Groups) == 0 {
+		return true
+	}
+
+	for _, u := range w.Users {
+		if u == user.Username {
+			return true
+		}
+	}
+
+	for _, g := range w.Groups {
+		for _, ug := range user.Groups {
+			if g == ug {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// compileWindows validates the time windows of a rule.
+func (r *Rule) compileWindows() error {
+	for idx := range r.Windows {
+		w := &r.Windows[idx]
+		if err := w.compile(); err != nil {
+			return fmt.Errorf("%s: %s", r.label(), err)
+		}
+
+		if (len(w.Users) > 0 || len(w.Groups) > 0) && r.Action != actionAuthorize {
+			return fmt.Errorf("%s: only authorize rules may limit time windows to users or groups", r.label())
+		}
+	}
+
+	return nil
+}
+
+// inWindow checks if a rule is active at a point in time. Rules without
+// windows are always active. Authorize rules are always active too, their
+// windows are applied to users instead.
+func (r *Rule) inWindow(now time.Time) bool {
+	if len(r.Windows) == 0 || r.Action == actionAuthorize {
+		return true
+	}
+
+	for idx := range r.Windows {
+		if r.Windows[idx].contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// userInWindow checks if a user may currently use an authorize rule. Users
+// not limited by any window always may, others have to be inside one of
+// the windows that limit them.
+func (r *Rule) userInWindow(user User, now time.Time) bool {
+
+	limited := false
+
+	for idx := range r.Windows {
+		w := &r.Windows[idx]
+		if !w.appliesTo(user) {
+			continue
+		}
+
+		limited = true
+		if w.contains(now) {
+			return true
+		}
+	}
+
+	return !limited
+}
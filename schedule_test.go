@@ -0,0 +1,73 @@
+package trauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	tests := []struct {
+		name   string
+		window TimeWindow
+		at     string
+		want   bool
+	}{
+		{"inside", TimeWindow{Start: "09:00", End: "17:00"}, "2024-06-03T12:00:00Z", true},
+		{"at start", TimeWindow{Start: "09:00", End: "17:00"}, "2024-06-03T09:00:00Z", true},
+		{"at end", TimeWindow{Start: "09:00", End: "17:00"}, "2024-06-03T17:00:00Z", false},
+		{"before start", TimeWindow{Start: "09:00", End: "17:00"}, "2024-06-03T08:59:00Z", false},
+
+		// 2024-06-03 is a monday
+		{"on a listed day", TimeWindow{Days: []string{"mon"}, Start: "09:00", End: "17:00"}, "2024-06-03T12:00:00Z", true},
+		{"on another day", TimeWindow{Days: []string{"mon"}, Start: "09:00", End: "17:00"}, "2024-06-04T12:00:00Z", false},
+		{"full day names", TimeWindow{Days: []string{"Tuesday"}, Start: "09:00", End: "17:00"}, "2024-06-04T12:00:00Z", true},
+
+		{"wrapping before midnight", TimeWindow{Start: "22:00", End: "06:00"}, "2024-06-03T23:30:00Z", true},
+		{"wrapping after midnight", TimeWindow{Start: "22:00", End: "06:00"}, "2024-06-04T05:59:00Z", true},
+		{"wrapping at end", TimeWindow{Start: "22:00", End: "06:00"}, "2024-06-04T06:00:00Z", false},
+		{"wrapping during the day", TimeWindow{Start: "22:00", End: "06:00"}, "2024-06-04T12:00:00Z", false},
+
+		// a window starting on friday night runs into saturday, but one
+		// on saturday night does not start
+		{"wrapping into the next day", TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, "2024-06-08T02:00:00Z", true},
+		{"wrapping on the next day", TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, "2024-06-08T23:00:00Z", false},
+		{"wrapping into the listed day", TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, "2024-06-07T02:00:00Z", false},
+		{"wrapping from sunday into monday", TimeWindow{Days: []string{"sun"}, Start: "22:00", End: "06:00"}, "2024-06-03T01:00:00Z", true},
+
+		{"in a time zone", TimeWindow{Start: "09:00", End: "17:00", TimeZone: "Europe/Amsterdam"}, "2024-06-03T07:30:00Z", true},
+		{"outside a time zone", TimeWindow{Start: "09:00", End: "17:00", TimeZone: "Europe/Amsterdam"}, "2024-06-03T15:30:00Z", false},
+		{"day in a time zone", TimeWindow{Days: []string{"tue"}, Start: "00:00", End: "02:00", TimeZone: "Europe/Amsterdam"}, "2024-06-03T23:00:00Z", true},
+	}
+
+	for _, test := range tests {
+		if err := test.window.compile(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		at, err := time.Parse(time.RFC3339, test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := test.window.contains(at); got != test.want {
+			t.Errorf("%s: contains %s = %t, want %t", test.name, test.at, got, test.want)
+		}
+	}
+}
+
+func TestTimeWindowInvalid(t *testing.T) {
+	tests := []TimeWindow{
+		{Start: "09:00"},
+		{Start: "9am", End: "17:00"},
+		{Start: "09:00", End: "24:00"},
+		{Start: "09:00", End: "09:00"},
+		{Start: "09:00", End: "17:00", Days: []string{"someday"}},
+		{Start: "09:00", End: "17:00", TimeZone: "Nowhere/Special"},
+	}
+
+	for _, window := range tests {
+		if err := window.compile(); err == nil {
+			t.Errorf("window %+v was accepted", window)
+		}
+	}
+}
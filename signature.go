@@ -0,0 +1,165 @@
+package trauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signatureMaxBody caps the size of a request body that is read to
+// verify its signature.
+const signatureMaxBody = 10 << 20
+
+// Signature configures HMAC verification of the requests matching a
+// rule, as used by webhooks.
+//
+// The signature in Header is the HMAC of the request body with Secret,
+// optionally preceded by Prefix (such as "sha256="). When
+// TimestampHeader is set, the signed content is the timestamp, a "."
+// and the body, and requests older than MaxAge seconds are refused.
+type Signature struct {
+	Secret          string `yaml:"secret"`
+	Header          string `yaml:"header"`
+	Algorithm       string `yaml:"algorithm"`
+	Prefix          string `yaml:"prefix"`
+	Encoding        string `yaml:"encoding"`
+	TimestampHeader string `yaml:"timestampheader"`
+	MaxAge          int    `yaml:"maxage"`
+}
+
+// signatureVerifier checks the signatures for one rule.
+type signatureVerifier struct {
+	config Signature
+	hash   func() hash.Hash
+	seen   *ticketCache
+}
+
+// compile validates the signature options and prepares the verifier.
+func (s *Signature) compile(domain string) (*signatureVerifier, error) {
+
+	if s.Secret == "" || s.Header == "" {
+		return nil, fmt.Errorf("signature for domain %s needs a secret and a header", domain)
+	}
+
+	v := &signatureVerifier{seen: newTicketCache()}
+
+	switch strings.ToLower(s.Algorithm) {
+	case "", "sha256":
+		v.hash = sha256.New
+	case "sha512":
+		v.hash = sha512.New
+	case "sha1":
+		v.hash = sha1.New
+	default:
+		return nil, fmt.Errorf("unknown signature algorithm '%s' for domain %s", s.Algorithm, domain)
+	}
+
+	s.Encoding = strings.ToLower(s.Encoding)
+	switch s.Encoding {
+	case "":
+		s.Encoding = "hex"
+	case "hex", "base64":
+	default:
+		return nil, fmt.Errorf("unknown signature encoding '%s' for domain %s", s.Encoding, domain)
+	}
+
+	if s.MaxAge <= 0 {
+		s.MaxAge = 300
+	}
+
+	v.config = *s
+
+	return v, nil
+}
+
+// verify checks the signature of a request, restoring its body for the
+// next handler. A reason is returned when the check fails.
+func (v *signatureVerifier) verify(req *http.Request) (bool, string) {
+
+	header := strings.TrimSpace(req.Header.Get(v.config.Header))
+	if !strings.HasPrefix(header, v.config.Prefix) || len(header) == len(v.config.Prefix) {
+		return false, "missing signature"
+	}
+
+	var got []byte
+	var err error
+	if v.config.Encoding == "base64" {
+		got, err = base64.StdEncoding.DecodeString(header[len(v.config.Prefix):])
+	} else {
+		got, err = hex.DecodeString(header[len(v.config.Prefix):])
+	}
+
+	if err != nil {
+		return false, "malformed signature"
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	mac := hmac.New(v.hash, []byte(v.config.Secret))
+
+	var timestamp string
+	if v.config.TimestampHeader != "" {
+		timestamp = strings.TrimSpace(req.Header.Get(v.config.TimestampHeader))
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false, "missing or malformed timestamp"
+		}
+
+		age := time.Since(time.Unix(ts, 0)).Seconds()
+		if math.Abs(age) > float64(v.config.MaxAge) {
+			return false, fmt.Sprintf("timestamp is %.0f seconds old", age)
+		}
+
+		mac.Write([]byte(timestamp + "."))
+	}
+
+	mac.Write(body)
+
+	if !hmac.Equal(mac.Sum(nil), got) {
+		return false, "invalid signature"
+	}
+
+	// within the window, a signed request may only be delivered once
+	if timestamp != "" && !v.seen.redeem(hex.EncodeToString(got), 2*time.Duration(v.config.MaxAge)*time.Second) {
+		return false, "replayed signature"
+	}
+
+	return true, ""
+}
+
+// readBody reads a request body and puts it back for whoever reads it next.
+func readBody(req *http.Request) ([]byte, error) {
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, signatureMaxBody+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %s", err)
+	}
+
+	if len(body) > signatureMaxBody {
+		return nil, fmt.Errorf("body is larger than %d bytes", signatureMaxBody)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
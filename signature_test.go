@@ -0,0 +1,155 @@
+package trauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signatureTestSecret = "webhook-secret"
+
+// signBody returns the HMAC of content with the test secret.
+func signBody(h func() hash.Hash, content string) []byte {
+	mac := hmac.New(h, []byte(signatureTestSecret))
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func newSignatureTestVerifier(t *testing.T, s Signature) *signatureVerifier {
+	t.Helper()
+
+	s.Secret = signatureTestSecret
+	v, err := s.compile("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestSignatureDigests(t *testing.T) {
+	body := `{"action":"opened"}`
+
+	tests := []struct {
+		name      string
+		signature Signature
+		header    string
+		ok        bool
+	}{
+		{"hex", Signature{Header: "X-Signature"}, hex.EncodeToString(signBody(sha256.New, body)), true},
+		{"prefixed hex", Signature{Header: "X-Signature", Prefix: "sha256="}, "sha256=" + hex.EncodeToString(signBody(sha256.New, body)), true},
+		{"base64", Signature{Header: "X-Signature", Encoding: "base64"}, base64.StdEncoding.EncodeToString(signBody(sha256.New, body)), true},
+		{"sha512", Signature{Header: "X-Signature", Algorithm: "sha512"}, hex.EncodeToString(signBody(sha512.New, body)), true},
+		{"other body", Signature{Header: "X-Signature"}, hex.EncodeToString(signBody(sha256.New, body+" ")), false},
+		{"other algorithm", Signature{Header: "X-Signature", Algorithm: "sha512"}, hex.EncodeToString(signBody(sha256.New, body)), false},
+		{"base64 as hex", Signature{Header: "X-Signature"}, base64.StdEncoding.EncodeToString(signBody(sha256.New, body)), false},
+		{"hex as base64", Signature{Header: "X-Signature", Encoding: "base64"}, hex.EncodeToString(signBody(sha256.New, body)), false},
+		{"missing prefix", Signature{Header: "X-Signature", Prefix: "sha256="}, hex.EncodeToString(signBody(sha256.New, body)), false},
+		{"only a prefix", Signature{Header: "X-Signature", Prefix: "sha256="}, "sha256=", false},
+		{"missing", Signature{Header: "X-Signature"}, "", false},
+	}
+
+	for _, test := range tests {
+		v := newSignatureTestVerifier(t, test.signature)
+
+		req := httptest.NewRequest("POST", "http://example.com/hooks", strings.NewReader(body))
+		req.Header.Set("X-Signature", test.header)
+
+		ok, reason := v.verify(req)
+		if ok != test.ok {
+			t.Errorf("%s: verified %t (%s), want %t", test.name, ok, reason, test.ok)
+		}
+
+		// the next handler still gets to read the body
+		if ok {
+			if got, _ := io.ReadAll(req.Body); string(got) != body {
+				t.Errorf("%s: body read after verifying is %q, want %q", test.name, got, body)
+			}
+		}
+	}
+}
+
+func TestSignatureTimestamp(t *testing.T) {
+	body := `{"action":"opened"}`
+
+	v := newSignatureTestVerifier(t, Signature{Header: "X-Signature", TimestampHeader: "X-Timestamp", MaxAge: 60})
+
+	signed := func(at time.Time, content string) (ok bool, reason string) {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+
+		req := httptest.NewRequest("POST", "http://example.com/hooks", strings.NewReader(body))
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", hex.EncodeToString(signBody(sha256.New, timestamp+"."+content)))
+
+		return v.verify(req)
+	}
+
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		content string
+		ok      bool
+	}{
+		{"current", now, body, true},
+		{"within max age", now.Add(-50 * time.Second), body, true},
+		{"stale", now.Add(-2 * time.Minute), body, false},
+		{"from the future", now.Add(2 * time.Minute), body, false},
+		{"timestamp not signed", now.Add(-10 * time.Second), body[1:], false},
+	}
+
+	for _, test := range tests {
+		if ok, reason := signed(test.at, test.content); ok != test.ok {
+			t.Errorf("%s: verified %t (%s), want %t", test.name, ok, reason, test.ok)
+		}
+	}
+
+	// a signed request may only be delivered once
+	if ok, _ := signed(now, body); ok {
+		t.Errorf("replayed request was verified")
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/hooks", strings.NewReader(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(signBody(sha256.New, body)))
+	if ok, _ := v.verify(req); ok {
+		t.Errorf("request without a timestamp was verified")
+	}
+}
+
+func TestSignatureBodyLimit(t *testing.T) {
+	body := strings.Repeat("a", signatureMaxBody+1)
+
+	v := newSignatureTestVerifier(t, Signature{Header: "X-Signature"})
+
+	req := httptest.NewRequest("POST", "http://example.com/hooks", strings.NewReader(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(signBody(sha256.New, body)))
+
+	if ok, _ := v.verify(req); ok {
+		t.Errorf("body larger than %d bytes was verified", signatureMaxBody)
+	}
+}
+
+func TestSignatureInvalid(t *testing.T) {
+	tests := []Signature{
+		{Header: "X-Signature"},
+		{Secret: signatureTestSecret},
+		{Secret: signatureTestSecret, Header: "X-Signature", Algorithm: "md5"},
+		{Secret: signatureTestSecret, Header: "X-Signature", Encoding: "base32"},
+	}
+
+	for _, s := range tests {
+		if _, err := s.compile("example.com"); err == nil {
+			t.Errorf("signature %+v was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package trauth
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// reservedPath is the path prefix trauth handles itself, rather than
+// passing requests on to the next handler.
+const reservedPath = `/_trauth/`
+
+const (
+	ssoLoginPath    = reservedPath + `sso/login`
+	ssoCallbackPath = reservedPath + `sso/callback`
+
+	ssoTicketName = `trauth-sso-ticket`
+
+	// ssoStateTTL is how long a client has to login on the hub.
+	ssoStateTTL = time.Hour
+)
+
+// ssoTicket is the signed value a hub hands to another domain
+// so that it can create its own local session.
+type ssoTicket struct {
+	Username string   `json:"u"`
+	Method   string   `json:"m"`
+	Groups   []string `json:"g,omitempty"`
+	Host     string   `json:"h"`
+	Nonce    string   `json:"n"`
+	State    string   `json:"s"`
+}
+
+// ticketCache remembers tickets that have been redeemed so that they
+// can not be used a second time while they are still valid.
+type ticketCache struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{used: make(map[string]time.Time)}
+}
+
+// redeem marks a nonce as used, returning false if it was used before.
+func (tc *ticketCache) redeem(nonce string, ttl time.Duration) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	now := time.Now()
+
+	// drop expired entries while we are here
+	for n, exp := range tc.used {
+		if now.After(exp) {
+			delete(tc.used, n)
+		}
+	}
+
+	if _, ok := tc.used[nonce]; ok {
+		return false
+	}
+
+	tc.used[nonce] = now.Add(ttl)
+
+	return true
+}
+
+// ssoEnabled returns true if this instance is a hub or a member domain.
+func (c *Config) ssoEnabled() bool {
+	return c.SSOHub != "" || len(c.SSODomains) > 0
+}
+
+// ssoAllowedHost checks if a host is in the hub's list of domains
+// that may receive tickets.
+func (c *Config) ssoAllowedHost(host string) bool {
+	for _, d := range c.SSODomains {
+		if strings.EqualFold(d, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripPort removes an optional port from a host value.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
+
+// requestScheme returns the scheme the client used for a request.
+func requestScheme(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	return scheme
+}
+
+// requestURL reconstructs the absolute URL the client requested.
+func requestURL(req *http.Request) string {
+	return fmt.Sprintf("%s://%s%s", requestScheme(req), req.Host, req.URL.RequestURI())
+}
+
+// localRedirect checks that a redirect target is a path on the current
+// host, preventing redirects to other sites.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") ||
+		strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+
+	return target
+}
+
+// ssoStateCookieName names the cookie a ticket has to be redeemed with.
+func (c *Config) ssoStateCookieName() string {
+	return c.CookieName + "-sso-state"
+}
+
+// redirectToHub sends an unauthenticated client to the sso hub to login.
+//
+// The state passed to the hub is also set in a cookie, and the ticket
+// the hub returns is only accepted along with it. This keeps a ticket
+// someone else obtained from logging the client in as them.
+func (t *Trauth) redirectToHub(rw http.ResponseWriter, req *http.Request) {
+
+	state := t.nonceCookie(rw, req, t.config.ssoStateCookieName(), ssoStateTTL)
+
+	target := t.config.ssoHubURL.JoinPath(ssoLoginPath)
+	target.RawQuery = url.Values{"rd": {requestURL(req)}, "state": {state}}.Encode()
+
+	http.Redirect(rw, req, target.String(), http.StatusFound)
+}
+
+// issueTicket is called on the hub for an authenticated user. It signs a
+// ticket for the requested domain and redirects the client there.
+func (t *Trauth) issueTicket(rw http.ResponseWriter, req *http.Request, user User) {
+
+	rd, err := url.Parse(req.URL.Query().Get("rd"))
+	if err != nil || (rd.Scheme != "http" && rd.Scheme != "https") || rd.Host == "" {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	host := stripPort(rd.Host)
+	if !t.config.ssoAllowedHost(host) {
+		t.logger.Printf("refusing to issue sso ticket for %s to unlisted domain %s", user.Username, host)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ticket, err := t.config.ssoCodec.Encode(ssoTicketName, ssoTicket{
+		Username: user.Username,
+		Method:   user.Method,
+		Groups:   user.Groups,
+		Host:     strings.ToLower(host),
+		Nonce:    hex.EncodeToString(securecookie.GenerateRandomKey(16)),
+		State:    req.URL.Query().Get("state"),
+	})
+	if err != nil {
+		t.logger.Printf("failed to sign sso ticket with: %s", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	callback := url.URL{
+		Scheme:   rd.Scheme,
+		Host:     rd.Host,
+		Path:     ssoCallbackPath,
+		RawQuery: url.Values{"ticket": {ticket}, "rd": {rd.RequestURI()}}.Encode(),
+	}
+
+	t.logger.Printf("issued sso ticket for %s to %s", user.Username, host)
+	http.Redirect(rw, req, callback.String(), http.StatusFound)
+}
+
+// redeemTicket is called on a member domain to exchange a ticket from the
+// hub for a local session.
+func (t *Trauth) redeemTicket(rw http.ResponseWriter, req *http.Request) {
+
+	var ticket ssoTicket
+	if err := t.config.ssoCodec.Decode(ssoTicketName, req.URL.Query().Get("ticket"), &ticket); err != nil {
+		t.logger.Printf("invalid sso ticket from %s: %s", req.RemoteAddr, err)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if ticket.Host != strings.ToLower(stripPort(req.Host)) {
+		t.logger.Printf("sso ticket for %s presented to %s from %s", ticket.Host, req.Host, req.RemoteAddr)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if !nonceCookieMatches(req, t.config.ssoStateCookieName(), ticket.State) {
+		t.logger.Printf("sso ticket for %s presented from %s without the state it was issued for",
+			ticket.Username, req.RemoteAddr)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if !t.tickets.redeem(ticket.Nonce, time.Duration(t.config.SSOTicketTTL)*time.Second) {
+		t.logger.Printf("replayed sso ticket for %s from %s", ticket.Username, req.RemoteAddr)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// the login happened on the hub, record how it was done there
+	method := joinMethods(authMethodSSO, ticket.Method)
+
+	if _, err := setUser(t.config, ticket.Username, method, ticket.Groups, rw, req); err != nil {
+		t.sessionFailed(rw, err)
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using an sso ticket", ticket.Username, req.RemoteAddr)
+	http.Redirect(rw, req, localRedirect(req.URL.Query().Get("rd")), http.StatusFound)
+}
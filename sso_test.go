@@ -0,0 +1,171 @@
+package trauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const ssoTestKey = "gbkkqkh8l1v2jd7ds4dbh6rvh1prxm2m"
+
+// newSSOTestPair returns a hub on auth.example.com and a member domain
+// app.example.io that logs in through it.
+func newSSOTestPair(t *testing.T) (hub, member http.Handler) {
+	t.Helper()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	c := CreateConfig()
+	c.Domain = "auth.example.com"
+	c.Users = "admin:$2y$05$glPGlcTOC.VMrpmK.ccmZeCiqyDYE96t7aUGCqmb8tuKXq6yoPzeG"
+	c.SSODomains = []string{"app.example.io"}
+	c.SSOKey = ssoTestKey
+
+	hub, err := New(context.Background(), next, c, "hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = CreateConfig()
+	c.Domain = "app.example.io"
+	c.SSOHub = "https://auth.example.com"
+	c.SSOKey = ssoTestKey
+
+	member, err = New(context.Background(), next, c, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hub, member
+}
+
+// ssoTicketURL logs in on the hub with Basic credentials, returning the
+// callback url the hub redirects to.
+func ssoTicketURL(t *testing.T, hub http.Handler, hubURL string) *url.URL {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", hubURL, nil)
+	req.SetBasicAuth("admin", "password")
+
+	rw := httptest.NewRecorder()
+	hub.ServeHTTP(rw, req)
+
+	// the hub may set its own session first, and ask for the page again
+	for i := 0; i < 2 && !strings.Contains(rw.Header().Get("Location"), ssoCallbackPath); i++ {
+		retry := httptest.NewRequest("GET", hubURL, nil)
+		for _, cookie := range rw.Result().Cookies() {
+			retry.AddCookie(cookie)
+		}
+
+		rw = httptest.NewRecorder()
+		hub.ServeHTTP(rw, retry)
+	}
+
+	callback, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil || callback.Path != ssoCallbackPath {
+		t.Fatalf("hub responded %d to %q, want a redirect to the callback", rw.Code, rw.Header().Get("Location"))
+	}
+
+	return callback
+}
+
+// redeemSSOTicket presents a callback url to the member domain along
+// with the given cookies.
+func redeemSSOTicket(member http.Handler, callback *url.URL, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", callback.String(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rw := httptest.NewRecorder()
+	member.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestSSOState(t *testing.T) {
+	hub, member := newSSOTestPair(t)
+
+	// the member domain sends the client to the hub with a state cookie
+	rw := httptest.NewRecorder()
+	member.ServeHTTP(rw, httptest.NewRequest("GET", "http://app.example.io/page", nil))
+
+	hubURL, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil || hubURL.Host != "auth.example.com" || hubURL.Path != ssoLoginPath {
+		t.Fatalf("member responded %d to %q, want a redirect to the hub", rw.Code, rw.Header().Get("Location"))
+	}
+
+	state := rw.Result().Cookies()
+	if len(state) != 1 || state[0].Value != hubURL.Query().Get("state") {
+		t.Fatalf("state cookie %v does not match the state passed to the hub", state)
+	}
+
+	callback := ssoTicketURL(t, hub, hubURL.String())
+
+	// a client that was not sent to the hub, or with the state of another login
+	other := &http.Cookie{Name: state[0].Name, Value: strings.Repeat("0", 32)}
+	for _, cookies := range [][]*http.Cookie{nil, {other}} {
+		if rw := redeemSSOTicket(member, callback, cookies); rw.Code != http.StatusUnauthorized {
+			t.Errorf("ticket with cookies %v responded %d, want %d", cookies, rw.Code, http.StatusUnauthorized)
+		}
+	}
+
+	rw = redeemSSOTicket(member, callback, state)
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/page" {
+		t.Fatalf("ticket responded %d to %q, want a redirect to /page", rw.Code, rw.Header().Get("Location"))
+	}
+
+	if len(rw.Result().Cookies()) == 0 {
+		t.Errorf("no session cookie was set")
+	}
+
+	if rw := redeemSSOTicket(member, callback, state); rw.Code != http.StatusUnauthorized {
+		t.Errorf("reused ticket responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSSOStateReused(t *testing.T) {
+	_, member := newSSOTestPair(t)
+
+	rw := httptest.NewRecorder()
+	member.ServeHTTP(rw, httptest.NewRequest("GET", "http://app.example.io/one", nil))
+
+	state := rw.Result().Cookies()
+	if len(state) != 1 {
+		t.Fatalf("set cookies %v, want a state cookie", state)
+	}
+
+	// a second tab logging in keeps the state of the first
+	req := httptest.NewRequest("GET", "http://app.example.io/two", nil)
+	req.AddCookie(state[0])
+
+	rw = httptest.NewRecorder()
+	member.ServeHTTP(rw, req)
+
+	hubURL, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil || hubURL.Query().Get("state") != state[0].Value {
+		t.Errorf("second login was sent to %q, want the state %s", rw.Header().Get("Location"), state[0].Value)
+	}
+
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("state cookie was replaced")
+	}
+}
+
+func TestSSOTicketWithoutState(t *testing.T) {
+	hub, member := newSSOTestPair(t)
+
+	// a ticket asked for without going through the member domain, as
+	// someone would to log a victim in as themselves
+	callback := ssoTicketURL(t, hub, "http://auth.example.com"+ssoLoginPath+"?rd="+url.QueryEscape("http://app.example.io/"))
+
+	rw := httptest.NewRecorder()
+	member.ServeHTTP(rw, httptest.NewRequest("GET", "http://app.example.io/", nil))
+
+	if rw := redeemSSOTicket(member, callback, rw.Result().Cookies()); rw.Code != http.StatusUnauthorized {
+		t.Errorf("ticket without state responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
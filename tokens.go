@@ -0,0 +1,269 @@
+package trauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenHashPrefix marks the supported hash of an api token. tokens are
+// long random strings, so a plain sha256 is enough to keep them from
+// being recovered from the configuration.
+const tokenHashPrefix = `sha256:`
+
+// APIToken is a static bearer token for a machine client.
+type APIToken struct {
+	Name    string   `yaml:"name" json:"name"`
+	Owner   string   `yaml:"owner" json:"owner,omitempty"`
+	Hash    string   `yaml:"hash" json:"hash"`
+	Groups  []string `yaml:"groups" json:"groups,omitempty"`
+	Expires string   `yaml:"expires" json:"expires,omitempty"`
+	Hosts   []string `yaml:"hosts" json:"hosts,omitempty"`
+
+	// "computed" values from configuration parsing
+	expires time.Time
+}
+
+// compile validates a token definition.
+func (at *APIToken) compile() ([sha256.Size]byte, error) {
+
+	var key [sha256.Size]byte
+
+	if at.Name == "" {
+		return key, fmt.Errorf("a token has no name")
+	}
+
+	if !strings.HasPrefix(at.Hash, tokenHashPrefix) {
+		return key, fmt.Errorf("token %s: hash must start with %s", at.Name, tokenHashPrefix)
+	}
+
+	raw, err := hex.DecodeString(strings.TrimPrefix(at.Hash, tokenHashPrefix))
+	if err != nil || len(raw) != sha256.Size {
+		return key, fmt.Errorf("token %s: hash is not a hex encoded sha256", at.Name)
+	}
+
+	copy(key[:], raw)
+
+	if at.Expires != "" {
+		if at.expires, err = time.Parse(time.RFC3339, at.Expires); err != nil {
+			return key, fmt.Errorf("token %s: invalid expires '%s', expected RFC 3339", at.Name, at.Expires)
+		}
+	}
+
+	for idx, host := range at.Hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return key, fmt.Errorf("token %s: host '%s' may only have a wildcard as its first label", at.Name, host)
+		}
+
+		at.Hosts[idx] = host
+	}
+
+	return key, nil
+}
+
+// allowsHost checks if a token may be used for a host. tokens without
+// hosts may be used everywhere.
+func (at *APIToken) allowsHost(host string) bool {
+
+	if len(at.Hosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+	for _, allowed := range at.Hosts {
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) && len(host) > len(allowed)-1 {
+				return true
+			}
+
+			continue
+		}
+
+		if host == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenStore holds api tokens by the hash of their value. tokens from a
+// file are reloaded when it changes, inline ones are fixed.
+type tokenStore struct {
+	mu     sync.RWMutex
+	inline map[[sha256.Size]byte]*APIToken
+	tokens map[[sha256.Size]byte]*APIToken
+	file   *watchedFile
+	logger *log.Logger
+}
+
+// indexTokens compiles tokens and indexes them by their hash.
+func indexTokens(tokens []APIToken, into map[[sha256.Size]byte]*APIToken) error {
+
+	for idx := range tokens {
+		key, err := tokens[idx].compile()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := into[key]; ok {
+			return fmt.Errorf("token %s: hash is used by another token", tokens[idx].Name)
+		}
+
+		into[key] = &tokens[idx]
+	}
+
+	return nil
+}
+
+// readTokens parses a tokens file, a json list of tokens.
+func readTokens(path string) ([]APIToken, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []APIToken
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return tokens, nil
+}
+
+func newTokenStore(inline []APIToken, path string) (*tokenStore, error) {
+
+	ts := &tokenStore{
+		inline: make(map[[sha256.Size]byte]*APIToken),
+		logger: NewLogger(),
+	}
+
+	if err := indexTokens(inline, ts.inline); err != nil {
+		return nil, err
+	}
+
+	ts.tokens = ts.inline
+
+	if path != "" {
+		ts.file = newWatchedFile(path)
+		if err := ts.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ts, nil
+}
+
+// load reads the tokens file, combining it with the inline tokens.
+func (ts *tokenStore) load() error {
+
+	fromFile, err := readTokens(ts.file.path)
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[[sha256.Size]byte]*APIToken, len(ts.inline)+len(fromFile))
+	for k, v := range ts.inline {
+		tokens[k] = v
+	}
+
+	if err := indexTokens(fromFile, tokens); err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.tokens = tokens
+	ts.mu.Unlock()
+
+	return nil
+}
+
+// reload re-reads the tokens file if it changed.
+func (ts *tokenStore) reload() {
+	if ts.file == nil || !ts.file.changed() {
+		return
+	}
+
+	if err := ts.load(); err != nil {
+		ts.logger.Printf("failed to reload tokens %s, keeping the previous ones: %s", ts.file.path, err)
+		return
+	}
+
+	ts.logger.Printf("reloaded api tokens from %s", ts.file.path)
+}
+
+// lookup returns the token with a value, if there is one.
+func (ts *tokenStore) lookup(value string) *APIToken {
+
+	ts.reload()
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.tokens[sha256.Sum256([]byte(value))]
+}
+
+// requestToken returns the api token a request carries, from the
+// configured header or an Authorization: Bearer header.
+func (c *Config) requestToken(req *http.Request) string {
+
+	if c.TokenHeader != "" {
+		return strings.TrimSpace(req.Header.Get(c.TokenHeader))
+	}
+
+	return bearerToken(req)
+}
+
+// bearerToken returns the value of an Authorization: Bearer header.
+func bearerToken(req *http.Request) string {
+
+	scheme, value, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(value)
+}
+
+// tryTokenAuth authenticates a request that carries an api token. like
+// stateless authentication, no session is created.
+func (t *Trauth) tryTokenAuth(rw http.ResponseWriter, req *http.Request, rule *Rule, value string) {
+
+	token := t.config.tokens.lookup(value)
+
+	switch {
+	case token == nil:
+		t.logger.Printf("unknown api token from %s to %s", req.RemoteAddr, req.Host)
+	case !token.expires.IsZero() && time.Now().After(token.expires):
+		t.logger.Printf("expired api token %s from %s to %s", token.Name, req.RemoteAddr, req.Host)
+		token = nil
+	case !token.allowsHost(req.Host):
+		t.logger.Printf("api token %s from %s is not allowed for %s", token.Name, req.RemoteAddr, req.Host)
+		token = nil
+	}
+
+	if token == nil {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, t.config.Realm))
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	t.logger.Printf("authenticated api token %s (owner %s) from %s to %s",
+		token.Name, token.Owner, req.RemoteAddr, req.Host)
+
+	t.forward(rw, req, User{
+		Username:      token.Name,
+		Authenticated: true,
+		Groups:        token.Groups,
+		Method:        authMethodToken,
+	}, rule)
+}
@@ -0,0 +1,98 @@
+package trauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tokenTestHash returns the configured form of a token value.
+func tokenTestHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+func TestTokenAuth(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.ForwardHeaders = true
+	c.Tokens = []APIToken{
+		{Name: "ci", Hash: tokenTestHash("ci-token")},
+		{Name: "old", Hash: tokenTestHash("old-token"), Expires: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		{Name: "later", Hash: tokenTestHash("later-token"), Expires: time.Now().Add(time.Hour).Format(time.RFC3339)},
+		{Name: "api", Hash: tokenTestHash("api-token"), Hosts: []string{"API.example.com"}},
+		{Name: "apps", Hash: tokenTestHash("apps-token"), Hosts: []string{"*.apps.example.com"}},
+	}
+
+	var user string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { user = req.Header.Get("X-Trauth-User") })
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		host  string
+		user  string
+	}{
+		{"ci-token", "example.com", "ci"},
+		{"ci-token", "other.example.org", "ci"},
+		{"unknown-token", "example.com", ""},
+		{"old-token", "example.com", ""},
+		{"later-token", "example.com", "later"},
+		{"api-token", "api.example.com:8443", "api"},
+		{"api-token", "example.com", ""},
+		{"api-token", "api.example.com.evil.com", ""},
+		{"apps-token", "wiki.apps.example.com", "apps"},
+		{"apps-token", "apps.example.com", ""},
+	}
+
+	for _, test := range tests {
+		user = ""
+
+		req := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if user != test.user {
+			t.Errorf("%s on %s: authenticated %q (responded %d), want %q", test.token, test.host, user, rw.Code, test.user)
+		}
+
+		if test.user == "" && rw.Code != http.StatusUnauthorized {
+			t.Errorf("%s on %s: responded %d, want %d", test.token, test.host, rw.Code, http.StatusUnauthorized)
+		}
+
+		// tokens authenticate a single request
+		if len(rw.Result().Cookies()) > 0 {
+			t.Errorf("%s on %s: a session cookie was set", test.token, test.host)
+		}
+	}
+}
+
+func TestTokenInvalid(t *testing.T) {
+	tests := []APIToken{
+		{Hash: tokenTestHash("token")},
+		{Name: "plain", Hash: "token"},
+		{Name: "short", Hash: tokenHashPrefix + "abcd"},
+		{Name: "expires", Hash: tokenTestHash("token"), Expires: "tomorrow"},
+		{Name: "hosts", Hash: tokenTestHash("token"), Hosts: []string{"api.*.example.com"}},
+	}
+
+	for _, token := range tests {
+		if _, err := token.compile(); err == nil {
+			t.Errorf("token %+v was accepted", token)
+		}
+	}
+
+	duplicate := []APIToken{{Name: "one", Hash: tokenTestHash("token")}, {Name: "two", Hash: tokenTestHash("token")}}
+	if _, err := newTokenStore(duplicate, ""); err == nil {
+		t.Errorf("tokens sharing a hash were accepted")
+	}
+}
@@ -0,0 +1,186 @@
+package trauth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of time steps either side of the current
+	// one that are accepted, allowing for clock drift.
+	totpSkew = 1
+)
+
+// totpStore holds the TOTP secrets of users, read from a file with one
+// username:secret pair per line, where the secret is base32 encoded as
+// most authenticator apps expect.
+type totpStore struct {
+	mu      sync.RWMutex
+	secrets map[string][]byte
+	file    *watchedFile
+	logger  *log.Logger
+
+	// used remembers the last time step each user logged in with,
+	// so that a code can not be used twice.
+	usedMu sync.Mutex
+	used   map[string]int64
+}
+
+// readTOTPSecrets parses a secrets file.
+func readTOTPSecrets(path string) (map[string][]byte, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, secret, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s line %d: expected username:secret", path, n)
+		}
+
+		key, err := decodeTOTPSecret(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, n, err)
+		}
+
+		secrets[user] = key
+	}
+
+	return secrets, scanner.Err()
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and padding.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid base32 secret")
+	}
+
+	return key, nil
+}
+
+func newTOTPStore(path string) (*totpStore, error) {
+
+	secrets, err := readTOTPSecrets(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &totpStore{
+		secrets: secrets,
+		file:    newWatchedFile(path),
+		logger:  NewLogger(),
+		used:    make(map[string]int64),
+	}, nil
+}
+
+// reload re-reads the secrets file if it changed.
+func (ts *totpStore) reload() {
+	if !ts.file.changed() {
+		return
+	}
+
+	secrets, err := readTOTPSecrets(ts.file.path)
+	if err != nil {
+		ts.logger.Printf("failed to reload totp secrets %s, keeping the previous ones: %s", ts.file.path, err)
+		return
+	}
+
+	ts.mu.Lock()
+	ts.secrets = secrets
+	ts.mu.Unlock()
+
+	ts.logger.Printf("reloaded totp secrets for %d users", len(secrets))
+}
+
+// enrolled checks if a user has a TOTP secret.
+func (ts *totpStore) enrolled(user string) bool {
+	if ts == nil {
+		return false
+	}
+
+	ts.reload()
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	_, ok := ts.secrets[user]
+
+	return ok
+}
+
+// totpCode computes the code for a time step as described in RFC 6238.
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verify checks a code for a user. A code is only accepted once, and
+// only codes newer than the last accepted one for that user are valid.
+func (ts *totpStore) verify(user, code string) bool {
+	if ts == nil || len(code) != totpDigits {
+		return false
+	}
+
+	ts.reload()
+
+	ts.mu.RLock()
+	key, ok := ts.secrets[user]
+	ts.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+
+	ts.usedMu.Lock()
+	defer ts.usedMu.Unlock()
+
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) != 1 {
+			continue
+		}
+
+		if step <= ts.used[user] {
+			ts.logger.Printf("refusing replayed totp code for %s", user)
+			return false
+		}
+
+		ts.used[user] = step
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,128 @@
+package trauth
+
+import (
+	"encoding/base32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the shared secret of the SHA1 test vectors in RFC 6238
+var totpTestKey = []byte("12345678901234567890")
+
+func TestTOTPCodeVectors(t *testing.T) {
+	// the last six digits of the eight digit codes in appendix B
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		if got := totpCode(totpTestKey, test.time/totpPeriod); got != test.code {
+			t.Errorf("code at %d = %s, want %s", test.time, got, test.code)
+		}
+	}
+}
+
+// newTOTPTestStore writes a secrets file for the given users, all with
+// the RFC 6238 test key.
+func newTOTPTestStore(t *testing.T, users ...string) *totpStore {
+	t.Helper()
+
+	secret := base32.StdEncoding.EncodeToString(totpTestKey)
+
+	var content string
+	for _, user := range users {
+		content += user + ":" + secret + "\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "totp")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := newTOTPStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts
+}
+
+// totpTestStep returns the current time step, waiting out the last
+// second of a step so that the store sees the same one.
+func totpTestStep() int64 {
+	if time.Now().Unix()%totpPeriod == totpPeriod-1 {
+		time.Sleep(time.Second)
+	}
+
+	return time.Now().Unix() / totpPeriod
+}
+
+func TestTOTPSkew(t *testing.T) {
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+
+	for _, test := range tests {
+		// a store per code, so that earlier steps are not refused as replays
+		ts := newTOTPTestStore(t, "alice")
+
+		if ok := ts.verify("alice", totpCode(totpTestKey, totpTestStep()+test.offset)); ok != test.ok {
+			t.Errorf("code %d steps from now verified %t, want %t", test.offset, ok, test.ok)
+		}
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	ts := newTOTPTestStore(t, "alice", "bob")
+
+	step := totpTestStep()
+
+	if !ts.verify("alice", totpCode(totpTestKey, step)) {
+		t.Fatalf("current code was refused")
+	}
+
+	if ts.verify("alice", totpCode(totpTestKey, step)) {
+		t.Errorf("code was accepted twice")
+	}
+
+	// an older code than the last one used is not valid either
+	if ts.verify("alice", totpCode(totpTestKey, step-1)) {
+		t.Errorf("code older than the last one used was accepted")
+	}
+
+	if !ts.verify("alice", totpCode(totpTestKey, step+1)) {
+		t.Errorf("code newer than the last one used was refused")
+	}
+
+	// the last step is remembered per user
+	if !ts.verify("bob", totpCode(totpTestKey, step)) {
+		t.Errorf("code used by another user was refused")
+	}
+}
+
+func TestTOTPUnknownUser(t *testing.T) {
+	ts := newTOTPTestStore(t, "alice")
+
+	for _, code := range []string{totpCode(totpTestKey, totpTestStep()), "", "12345"} {
+		if ts.verify("mallory", code) {
+			t.Errorf("code %q was accepted for a user without a secret", code)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Trauth is a Traefik plugin.
@@ -15,7 +18,11 @@ type Trauth struct {
 	name   string
 	config *Config
 
-	logger *log.Logger
+	logger      *log.Logger
+	tickets     *ticketCache
+	credentials *credentialCache
+	challenges  *challengeStore
+	logins      *rateLimiter
 }
 
 // New created a new plugin.
@@ -34,48 +41,330 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 
 	// return the plugin instance
 	return &Trauth{
-		next:   next,
-		name:   name,
-		config: config,
-		logger: NewLogger(),
+		next:       next,
+		name:       name,
+		config:     config,
+		logger:     NewLogger(),
+		tickets:    newTicketCache(),
+		challenges: newChallengeStore(),
+		logins:     newLoginLimiter(),
+
+		credentials: newCredentialCache(time.Duration(config.CredentialCacheTTL) * time.Second),
 	}, nil
 }
 
 func (t *Trauth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
-	if skipViaRule(t.config.Rules, req) {
-		t.next.ServeHTTP(rw, req)
+	// never trust identity headers sent by a client
+	stripUserHeaders(req)
+	if t.config.identity != nil {
+		req.Header.Del(t.config.IdentityHeader)
+	}
+
+	// also removes the asserted identity header when a proxy may not set it
+	asserted := t.assertedIdentity(req)
+
+	// sso tickets are exchanged before anything else, the client
+	// does not have a session on this domain yet.
+	if t.config.ssoEnabled() && req.URL.Path == ssoCallbackPath {
+		t.redeemTicket(rw, req)
 		return
 	}
 
-	user := getUser(t.config, req)
+	if strings.HasPrefix(req.URL.Path, reservedPath) && t.serveReserved(rw, req) {
+		return
+	}
+
+	rule := matchRule(t.config.Rules, req, newRequestInfo(req, t.config.geoDB), t.debugf)
+
+	if t.config.DecisionHeader {
+		decision := "none"
+		if rule != nil {
+			decision = fmt.Sprintf("%s; action=%s", rule.label(), rule.Action)
+		}
+
+		rw.Header().Set("X-Trauth-Decision", decision)
+	}
+
+	if rule != nil {
+		switch rule.Action {
+		case actionAllow:
+			// bypassed requests are limited by user too, if they have a session
+			if rule.limiter != nil && t.rateLimited(rw, req, rule, t.currentUser(req)) {
+				return
+			}
+
+			// signed requests, such as webhooks, are only let through once verified
+			if rule.verifier != nil {
+				if ok, reason := rule.verifier.verify(req); !ok {
+					t.logger.Printf("refusing request from %s to %s%s matching %s: %s",
+						req.RemoteAddr, req.Host, req.URL.Path, rule.label(), reason)
+					http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+			}
+
+			t.next.ServeHTTP(rw, req)
+			return
+		case actionDeny:
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	user := t.currentUser(req)
+	t.debugf("session for %s%s: authenticated=%t user=%q method=%q",
+		req.Host, req.URL.Path, user.Authenticated, user.Username, user.Method)
+
+	// a trusted proxy decides who the user is, even over an existing session
+	if asserted != "" && (!user.Authenticated || user.Username != asserted) {
+		t.tryProxyAuth(rw, req, rule, asserted)
+		return
+	}
 
 	if auth := user.Authenticated; !auth {
 		if t.config.LogUnauthenticated {
 			t.logger.Printf("unauthenticated request from %s to %s%s", req.RemoteAddr, req.Host, req.URL.Path)
 		}
 
+		// jwts and api tokens authenticate a single request, without a session
+		if t.config.jwtKeys != nil {
+			if value := bearerToken(req); looksLikeJWT(value) {
+				t.tryJWTAuth(rw, req, rule, value)
+				return
+			}
+		}
+
+		if t.config.tokens != nil {
+			if value := t.config.requestToken(req); value != "" {
+				t.tryTokenAuth(rw, req, rule, value)
+				return
+			}
+		}
+
+		// machine clients authenticate each request on its own
+		if t.statelessRequest(req, rule) {
+			t.tryStatelessAuth(rw, req, rule)
+			return
+		}
+
 		// check if we can try and do mTLS
 		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
-			t.tryMTLSAuth(rw, req)
+			t.tryMTLSAuth(rw, req, rule)
+			return
+		}
+
+		// let the sso hub authenticate the client if we have one
+		if t.config.ssoHubURL != nil {
+			t.redirectToHub(rw, req)
+			return
+		}
+
+		// browsers get the login page when they can use passkeys or email
+		// links, or may have to answer a radius challenge
+		if t.config.usesLoginPage() && wantsHTML(req) {
+			redirectToLogin(rw, req)
 			return
 		}
 
 		// fall back to basic authentication
-		t.tryBasicAuth(rw, req)
+		t.tryBasicAuth(rw, req, rule)
+		return
+	}
+
+	// an authenticated user on the hub asking for a ticket to another domain
+	if len(t.config.SSODomains) > 0 && req.URL.Path == ssoLoginPath {
+		t.issueTicket(rw, req, user)
+		return
+	}
+
+	t.forward(rw, req, user, rule)
+}
+
+// serveReserved handles requests to trauth's own endpoints, returning
+// false for paths that should go through the normal authentication flow.
+func (t *Trauth) serveReserved(rw http.ResponseWriter, req *http.Request) bool {
+
+	if req.URL.Path == whoamiPath {
+		t.serveWhoami(rw, t.currentUser(req))
+		return true
+	}
+
+	if req.URL.Path == jwksPath && t.config.identity != nil {
+		t.serveJWKS(rw)
+		return true
+	}
+
+	if t.config.usesLoginPage() {
+		user := t.currentUser(req)
+		if t.serveLogin(rw, req, user) {
+			return true
+		}
+
+		if t.config.webauthn != nil && t.serveWebAuthn(rw, req, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forward passes a request from an authenticated user on to the next
+// handler, provided the matching rule (if any) authorizes the user.
+func (t *Trauth) forward(rw http.ResponseWriter, req *http.Request, user User, rule *Rule) {
+
+	if rule != nil && !rule.satisfiedBy(user) {
+		t.stepUp(rw, req, user, rule)
 		return
 	}
 
+	if rule != nil && rule.Action == actionAuthorize && !rule.authorized(user) {
+		t.logger.Printf("%s is not authorized for %s%s", user.Username, req.Host, req.URL.Path)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if t.rateLimited(rw, req, rule, user) {
+		return
+	}
+
+	if t.config.ForwardHeaders {
+		setUserHeaders(user, req)
+	}
+
+	if t.config.identity != nil {
+		if err := t.setIdentityToken(user, req); err != nil {
+			t.logger.Printf("failed to sign identity token for %s with error: %s", user.Username, err)
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	t.next.ServeHTTP(rw, req)
 }
 
+// stepUp upgrades a session that did not use an authentication method a
+// rule requires, by authenticating the same user again with that method.
+func (t *Trauth) stepUp(rw http.ResponseWriter, req *http.Request, user User, rule *Rule) {
+
+	var name, method string
+
+	for _, required := range rule.AuthMethods {
+		switch required {
+		case authMethodMTLS:
+			if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+				name, _ = t.verifyClientCert(req)
+				method = authMethodMTLS
+			}
+		case authMethodBasic, authMethodTOTP:
+			if u, pass, ok := req.BasicAuth(); ok && t.config.hasPasswords() {
+				if checked, err := t.checkCredentials(u, pass); err == nil && checked.hasMethod(required) {
+					name = u
+					method = checked.Method
+				}
+			}
+		}
+
+		if name != "" {
+			break
+		}
+	}
+
+	if name == "" {
+		t.logger.Printf("%s session for %s does not satisfy %s on %s%s",
+			user.Method, user.Username, strings.Join(rule.AuthMethods, " or "), req.Host, req.URL.Path)
+
+		// a password or passkey are the only things we can still ask for.
+		// for client certificates, the tls handshake is where they are requested.
+		for _, required := range rule.AuthMethods {
+			if required == authMethodWebAuthn && t.config.webauthn != nil && wantsHTML(req) {
+				redirectToLogin(rw, req)
+				return
+			}
+
+			if (required == authMethodBasic || required == authMethodTOTP) && t.config.hasPasswords() {
+				rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, t.config.Realm))
+				http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if name != user.Username {
+		t.logger.Printf("refusing step-up of %s session for %s to %s credentials of %s",
+			user.Method, user.Username, method, name)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	user.Method = joinMethods(user.Method, method)
+
+	// stateless requests have no session to upgrade
+	if !t.statelessRequest(req, rule) {
+		if err := saveUser(t.config, user, rw, req); err != nil {
+			t.sessionFailed(rw, err)
+			return
+		}
+	}
+
+	t.logger.Printf("stepped up session for %s from %s using %s", user.Username, req.RemoteAddr, method)
+	t.forward(rw, req, user, rule)
+}
+
+// currentUser returns the user for the session cookie in a request,
+// provided the session may still be used from this client.
+func (t *Trauth) currentUser(req *http.Request) User {
+
+	user := getUser(t.config, req)
+
+	if user.Authenticated {
+		if ok, reason := sessionBound(t.config, user, req); !ok {
+			t.logger.Printf("rejecting %s session for %s (issued %s from %s): %s",
+				user.Method, user.Username, user.IssuedAt.Format(time.RFC3339), user.IP, reason)
+			return User{Authenticated: false}
+		}
+	}
+
+	return user
+}
+
+// sessionFailed fails a request for which the session cookie could not
+// be saved, such as when it grew too large.
+func (t *Trauth) sessionFailed(rw http.ResponseWriter, err error) {
+	t.logger.Printf("failed to save user session data with: %s", err)
+	http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
 // tryMTLSAuth will check for any client certificates and validate them.
-func (t *Trauth) tryMTLSAuth(rw http.ResponseWriter, req *http.Request) {
+func (t *Trauth) tryMTLSAuth(rw http.ResponseWriter, req *http.Request, rule *Rule) {
+
+	name, ok := t.verifyClientCert(req)
+	if !ok {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := setUser(t.config, name, authMethodMTLS, nil, rw, req)
+	if err != nil {
+		t.sessionFailed(rw, err)
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using mTLS", name, req.RemoteAddr)
+	t.completeLogin(rw, req, user, rule)
+}
+
+// verifyClientCert checks the peer certificates of a request against the
+// configured ca, returning the common name of the first valid one.
+func (t *Trauth) verifyClientCert(req *http.Request) (string, bool) {
 
 	// this is an important case. if Roots for Verify() is nil, it will use the
 	// system CA pool. avoid that.
 	if t.config.CertPool == nil {
-		return
+		return "", false
 	}
 
 	// check each peer certificate against the configured ca
@@ -86,28 +375,21 @@ func (t *Trauth) tryMTLSAuth(rw http.ResponseWriter, req *http.Request) {
 
 		// an empty error implies a valid certificate
 		if err == nil {
-			if err := setUser(t.config, cert.Subject.CommonName, rw, req); err != nil {
-				t.logger.Fatalf("failed to save user session data with: %s\n", err)
-			}
-
-			t.logger.Printf("authenticated %s from %s using mTLS", cert.Subject.CommonName, req.RemoteAddr)
-			http.Redirect(rw, req, req.URL.RequestURI(), http.StatusFound)
-
-			return
+			return cert.Subject.CommonName, true
 		}
 	}
 
-	http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return "", false
 }
 
 // tryBasicAuth with prompt for HTTP basic authentication credentials
 // and read the response to determine if valid credentials were given
-func (t *Trauth) tryBasicAuth(rw http.ResponseWriter, req *http.Request) {
+func (t *Trauth) tryBasicAuth(rw http.ResponseWriter, req *http.Request, rule *Rule) {
 
-	// ensure htpassword is configured. as this is the last auth method we support,
-	// return an error http code in case we dont have an htpasswd instance (meaning there
+	// ensure htpassword or ldap is configured. as this is the last auth method we
+	// support, return an error http code in case we dont have either (meaning there
 	// are no credentials configured to test to begin with)
-	if t.config.htpasswd == nil {
+	if !t.config.hasPasswords() {
 		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -120,15 +402,202 @@ func (t *Trauth) tryBasicAuth(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !t.config.htpasswd.Match(user, pass) {
+	checked, err := t.checkCredentials(user, pass)
+	if err != nil {
 		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
-	if err := setUser(t.config, user, rw, req); err != nil {
-		t.logger.Fatalf("failed to save user session data with: %s\n", err)
+	session, err := setUser(t.config, user, checked.Method, checked.Groups, rw, req)
+	if err != nil {
+		t.sessionFailed(rw, err)
+		return
 	}
 
 	t.logger.Printf("authenticated %s from %s using HTTP Basic authentication", user, req.RemoteAddr)
-	http.Redirect(rw, req, req.URL.RequestURI(), http.StatusFound)
+	t.completeLogin(rw, req, session, rule)
+}
+
+// checkCredentials verifies a username and password, returning the
+// user they authenticate with the method they satisfy and any groups.
+//
+// Users with a TOTP secret append their current code to the password,
+// and have it checked as a second factor. A *radiusChallenge error is
+// returned when a radius server wants more than the password, which
+// only the login form can ask the user for.
+func (t *Trauth) checkCredentials(user, pass string) (User, error) {
+
+	method := authMethodBasic
+
+	if t.config.totp.enrolled(user) {
+		if len(pass) <= totpDigits {
+			return User{}, errInvalidCredentials
+		}
+
+		var code string
+		pass, code = pass[:len(pass)-totpDigits], pass[len(pass)-totpDigits:]
+
+		// check the password first, so that a wrong one does not use up a code
+		groups, err := t.checkPassword(user, pass)
+
+		var challenge *radiusChallenge
+		if err != nil && !errors.As(err, &challenge) {
+			return User{}, err
+		}
+
+		if !t.config.totp.verify(user, code) {
+			return User{}, errInvalidCredentials
+		}
+
+		method = joinMethods(authMethodBasic, authMethodTOTP)
+
+		if challenge != nil {
+			challenge.method = method
+			return User{}, challenge
+		}
+
+		return User{Username: user, Authenticated: true, Method: method, Groups: groups}, nil
+	}
+
+	if t.config.TOTPRequired {
+		t.logger.Printf("refusing login for %s who has not enrolled a totp secret", user)
+		return User{}, errInvalidCredentials
+	}
+
+	groups, err := t.checkPassword(user, pass)
+	if err != nil {
+		var challenge *radiusChallenge
+		if errors.As(err, &challenge) {
+			challenge.method = method
+		}
+
+		return User{}, err
+	}
+
+	return User{Username: user, Authenticated: true, Method: method, Groups: groups}, nil
+}
+
+// checkPassword verifies a username and password, consulting the
+// cache of recently verified credentials first, then htpasswd users,
+// the ldap directory and the radius servers. The groups of the user
+// are returned.
+func (t *Trauth) checkPassword(user, pass string) ([]string, error) {
+
+	if groups, ok := t.credentials.valid(user, pass); ok {
+		return groups, nil
+	}
+
+	if t.config.htpasswd != nil && t.config.htpasswd.Match(user, pass) {
+		t.credentials.add(user, pass, nil)
+		return nil, nil
+	}
+
+	if t.config.ldap != nil {
+		groups, err := t.config.ldap.authenticate(user, pass)
+		if err == nil {
+			t.credentials.add(user, pass, groups)
+			return groups, nil
+		}
+
+		if !errors.Is(err, errLDAPRejected) {
+			t.logger.Printf("failed to check ldap credentials for %s with error: %s", user, err)
+		} else {
+			t.debugf("ldap rejected credentials for %s: %s", user, err)
+		}
+	}
+
+	if t.config.radius != nil {
+		// radius users often log in with one-time passwords, which
+		// are not cached so that they can not be used again
+		groups, err := t.config.radius.authenticate(user, pass)
+
+		var challenge *radiusChallenge
+		switch {
+		case err == nil:
+			return groups, nil
+		case errors.As(err, &challenge):
+			t.debugf("radius challenge for %s: %s", user, challenge.message)
+			return nil, err
+		case !errors.Is(err, errInvalidCredentials):
+			t.logger.Printf("failed to check radius credentials for %s with error: %s", user, err)
+		}
+	}
+
+	return nil, errInvalidCredentials
+}
+
+// statelessRequest determines if a request should be authenticated on
+// its own, without a session cookie being issued. rule is the rule the
+// request matched, if any.
+func (t *Trauth) statelessRequest(req *http.Request, rule *Rule) bool {
+
+	if rule != nil && rule.Stateless {
+		return true
+	}
+
+	switch t.config.Stateless {
+	case statelessAlways:
+		return true
+	case statelessAuto:
+		// clients without a cookie jar that do not want html are
+		// most likely scripts or other machines
+		if len(req.Cookies()) > 0 {
+			return false
+		}
+
+		return !strings.Contains(req.Header.Get("Accept"), "text/html")
+	}
+
+	return false
+}
+
+// tryStatelessAuth authenticates a single request using the credentials
+// it carries, forwarding it on success without writing a session.
+func (t *Trauth) tryStatelessAuth(rw http.ResponseWriter, req *http.Request, rule *Rule) {
+
+	var user User
+
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		if name, ok := t.verifyClientCert(req); ok {
+			user = User{Username: name, Authenticated: true, Method: authMethodMTLS}
+		}
+	}
+
+	if name, pass, ok := req.BasicAuth(); !user.Authenticated && ok && t.config.hasPasswords() {
+		if checked, err := t.checkCredentials(name, pass); err == nil {
+			user = checked
+		}
+	}
+
+	if !user.Authenticated {
+		if t.config.hasPasswords() {
+			rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, t.config.Realm))
+		}
+
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	t.forward(rw, req, user, rule)
+}
+
+// completeLogin finishes a request that just created a session.
+//
+// Safe requests are redirected to themselves so that the client
+// continues with the new cookie. Other methods, or all requests when
+// loginpassthrough is set, are passed straight on to the next handler
+// so that request bodies are not lost. The session cookie is part of
+// that response.
+func (t *Trauth) completeLogin(rw http.ResponseWriter, req *http.Request, user User, rule *Rule) {
+
+	// the challenge header was set before we knew the credentials were valid
+	rw.Header().Del("WWW-Authenticate")
+
+	if t.config.LoginPassThrough || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		t.forward(rw, req, user, rule)
+		return
+	}
+
+	// a 307 keeps the request method should a client follow it anyway
+	http.Redirect(rw, req, req.URL.RequestURI(), http.StatusTemporaryRedirect)
 }
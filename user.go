@@ -1,15 +1,110 @@
 package trauth
 
-import "net/http"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication methods recorded in a users session.
+const (
+	authMethodBasic = `basic`
+	authMethodEmail = `email`
+	authMethodJWT   = `jwt`
+	authMethodMTLS  = `mtls`
+	authMethodProxy = `proxy`
+	authMethodSSO   = `sso`
+	authMethodTOTP  = `totp`
+	authMethodToken = `token`
+
+	authMethodWebAuthn = `webauthn`
+)
 
 // User holds a users session information.
 type User struct {
 	Username      string
 	Authenticated bool
+	Groups        []string
+
+	// Session metadata recorded at login time
+	Method    string
+	IssuedAt  time.Time
+	IP        string
+	UserAgent string
+
+	// SavedAt is when the session cookie was last written, which is
+	// when its max age started counting, for example after a step-up
+	SavedAt time.Time
+}
+
+// authMethods are the methods rules can require sessions to have used.
+var authMethods = map[string]bool{
+	authMethodBasic: true,
+	authMethodEmail: true,
+	authMethodJWT:   true,
+	authMethodMTLS:  true,
+	authMethodProxy: true,
+	authMethodSSO:   true,
+	authMethodTOTP:  true,
+	authMethodToken: true,
+
+	authMethodWebAuthn: true,
 }
 
 const cookieKey = `user`
 
+// Limits on the groups kept in a session. Directories can put a user in
+// hundreds of groups, which would not fit in a cookie.
+const (
+	maxSessionGroups     = 32
+	maxSessionGroupBytes = 1024
+)
+
+// joinMethods combines authentication methods, skipping any that are
+// already part of the existing ones.
+func joinMethods(existing string, methods ...string) string {
+	joined := existing
+	for _, method := range methods {
+		for _, m := range strings.Split(method, "+") {
+			if m == "" || (User{Method: joined}).hasMethod(m) {
+				continue
+			}
+
+			if joined != "" {
+				joined += "+"
+			}
+
+			joined += m
+		}
+	}
+
+	return joined
+}
+
+// hasMethod checks if a session was authenticated using a method. Methods
+// are joined with a + when a session used more than one, for example
+// after a step-up, or when it came from an sso hub.
+func (u User) hasMethod(method string) bool {
+	for _, m := range strings.Split(u.Method, "+") {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hashUserAgent returns a digest of a user agent string, so that the
+// full value does not need to be kept in the cookie.
+func hashUserAgent(ua string) string {
+	sum := sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:8])
+}
+
 func getUser(config *Config, req *http.Request) User {
 
 	session, _ := config.cookieStore.Get(req, config.CookieName)
@@ -22,17 +117,117 @@ func getUser(config *Config, req *http.Request) User {
 	return user
 }
 
-func setUser(config *Config, user string, rw http.ResponseWriter, req *http.Request) error {
+func setUser(config *Config, user string, method string, groups []string, rw http.ResponseWriter, req *http.Request) (User, error) {
 
-	session, _ := config.cookieStore.Get(req, config.CookieName)
-	session.Values[cookieKey] = &User{
+	var ip string
+	if source := clientIP(req); source != nil {
+		ip = source.String()
+	}
+
+	u := User{
 		Username:      user,
 		Authenticated: true,
+		Method:        method,
+		Groups:        sessionGroups(config, groups),
+		IssuedAt:      time.Now().UTC(),
+		IP:            ip,
+		UserAgent:     hashUserAgent(req.UserAgent()),
+	}
+
+	return u, saveUser(config, u, rw, req)
+}
+
+// sessionGroups picks the groups of a user to keep in their session.
+// Groups that rules refer to are always kept, so that authorization does
+// not depend on the order a backend returned them in. Other groups are
+// only kept while there is room for them.
+func sessionGroups(config *Config, groups []string) []string {
+
+	var kept []string
+	seen := make(map[string]bool, len(groups))
+	size := 0
+
+	for _, referenced := range []bool{true, false} {
+		for _, g := range groups {
+			if seen[g] || config.ruleGroups[g] != referenced {
+				continue
+			}
+
+			if !referenced && (len(kept) >= maxSessionGroups || size+len(g) > maxSessionGroupBytes) {
+				continue
+			}
+
+			seen[g] = true
+			kept = append(kept, g)
+			size += len(g)
+		}
 	}
 
-	if err := config.cookieStore.Save(req, rw, session); err != nil {
-		return err
+	return kept
+}
+
+// saveUser writes a user to the session cookie.
+func saveUser(config *Config, u User, rw http.ResponseWriter, req *http.Request) error {
+
+	session, _ := config.cookieStore.Get(req, config.CookieName)
+	u.SavedAt = time.Now().UTC()
+	session.Values[cookieKey] = &u
+
+	return config.cookieStore.Save(req, rw, session)
+}
+
+// sessionBound checks that a session is used from the same client
+// network and user agent it was created with, if configured to do so.
+// A reason is returned when the check fails.
+func sessionBound(config *Config, user User, req *http.Request) (bool, string) {
+
+	if config.BindSessionUserAgent && user.UserAgent != hashUserAgent(req.UserAgent()) {
+		return false, "user agent changed"
 	}
 
-	return nil
+	if config.BindSessionIP {
+		source := clientIP(req)
+		issued := net.ParseIP(user.IP)
+		if source == nil || issued == nil {
+			return false, "client ip unknown"
+		}
+
+		if !sameSubnet(source, issued, config.SessionIPv4Prefix, config.SessionIPv6Prefix) {
+			return false, "client ip changed from " + user.IP
+		}
+	}
+
+	return true, ""
+}
+
+// sameSubnet compares two addresses after applying the prefix length
+// for their address family.
+func sameSubnet(a, b net.IP, v4prefix, v6prefix int) bool {
+	if (a.To4() == nil) != (b.To4() == nil) {
+		return false
+	}
+
+	mask := net.CIDRMask(v6prefix, 128)
+	if a4 := a.To4(); a4 != nil {
+		a, b = a4, b.To4()
+		mask = net.CIDRMask(v4prefix, 32)
+	}
+
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
+
+// setUserHeaders passes the session metadata on to the next handler.
+func setUserHeaders(user User, req *http.Request) {
+	req.Header.Set("X-Trauth-User", user.Username)
+	req.Header.Set("X-Trauth-Auth-Method", user.Method)
+	if !user.IssuedAt.IsZero() {
+		req.Header.Set("X-Trauth-Auth-Time", strconv.FormatInt(user.IssuedAt.Unix(), 10))
+	}
+}
+
+// stripUserHeaders removes any identity headers a client may have sent.
+func stripUserHeaders(req *http.Request) {
+	for _, h := range []string{"X-Trauth-User", "X-Trauth-Auth-Method", "X-Trauth-Auth-Time"} {
+		req.Header.Del(h)
+	}
 }
@@ -0,0 +1,54 @@
+package trauth
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetUserManyGroups(t *testing.T) {
+	gob.Register(User{})
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.Rules = []Rule{{Action: actionAuthorize, Groups: []string{"ops"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var groups []string
+	for i := 0; i < ldapMaxGroups; i++ {
+		groups = append(groups, fmt.Sprintf("cn-directory-group-%04d", i))
+	}
+
+	// the group a rule refers to comes last, it has to be kept anyway
+	groups = append(groups, "ops")
+
+	rw := httptest.NewRecorder()
+	u, err := setUser(c, "alice", authMethodBasic, groups, rw, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("setUser: %s", err)
+	}
+
+	if len(u.Groups) > maxSessionGroups+1 {
+		t.Errorf("kept %d groups, want at most %d", len(u.Groups), maxSessionGroups+1)
+	}
+
+	if !(&c.Rules[0]).authorized(u) {
+		t.Errorf("groups %q lost the group the rule refers to", u.Groups)
+	}
+
+	if len(rw.Result().Cookies()) != 1 {
+		t.Errorf("session cookie was not set")
+	}
+}
+
+func TestSessionGroupsDuplicates(t *testing.T) {
+	c := &Config{ruleGroups: map[string]bool{"b": true}}
+
+	got := sessionGroups(c, []string{"a", "b", "a", "b", "c"})
+	if fmt.Sprint(got) != "[b a c]" {
+		t.Errorf("sessionGroups = %q, want [b a c]", got)
+	}
+}
@@ -0,0 +1,801 @@
+package trauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	webauthnRegisterBeginPath  = reservedPath + `webauthn/register/begin`
+	webauthnRegisterFinishPath = reservedPath + `webauthn/register/finish`
+	webauthnLoginBeginPath     = reservedPath + `webauthn/login/begin`
+	webauthnLoginFinishPath    = reservedPath + `webauthn/login/finish`
+
+	// webauthnTimeout is how long a client has to answer a challenge.
+	webauthnTimeout = 2 * time.Minute
+)
+
+// COSE algorithm identifiers for the public key types trauth accepts.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataAttestedData = 0x40
+)
+
+var b64url = base64.RawURLEncoding
+
+// webauthnCredential is a registered passkey.
+type webauthnCredential struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	PublicKey []byte    `json:"public_key"`
+	SignCount uint32    `json:"sign_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webauthnFileLocks holds a lock per credentials file. Traefik runs a
+// middleware instance per router, and keeps old ones around after a
+// configuration reload, so several stores can share the same file.
+var webauthnFileLocks sync.Map
+
+// webauthnStore keeps credentials in a json file, keyed by credential id.
+//
+// The file is the source of truth. It is read again whenever it changed,
+// and changes are made to a fresh copy of it, so that stores sharing the
+// file do not undo each other's changes.
+type webauthnStore struct {
+	// file is shared by the stores of the same path, and is taken
+	// before mu when both are needed
+	file *sync.Mutex
+
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	creds   map[string]*webauthnCredential
+}
+
+func newWebAuthnStore(path string) (*webauthnStore, error) {
+
+	lock, _ := webauthnFileLocks.LoadOrStore(path, &sync.Mutex{})
+	store := &webauthnStore{file: lock.(*sync.Mutex), path: path, creds: make(map[string]*webauthnCredential)}
+
+	if err := store.load(true); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// load reads the credentials file, unless it did not change since it
+// was last read and force is not set. The caller must hold mu.
+func (ws *webauthnStore) load(force bool) error {
+
+	info, err := os.Stat(ws.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !force && info.ModTime().Equal(ws.modTime) && info.Size() == ws.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(ws.path)
+	if err != nil {
+		return err
+	}
+
+	var list []*webauthnCredential
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", ws.path, err)
+		}
+	}
+
+	creds := make(map[string]*webauthnCredential, len(list))
+	for _, cred := range list {
+		creds[cred.ID] = cred
+	}
+
+	ws.creds = creds
+	ws.modTime = info.ModTime()
+	ws.size = info.Size()
+
+	return nil
+}
+
+// refresh picks up changes made to the file by other stores, keeping
+// the credentials that were read before if it can not be read.
+func (ws *webauthnStore) refresh() {
+	_ = ws.load(false)
+}
+
+// update applies a change to the credentials as they are on disk, and
+// saves them if change returns true.
+func (ws *webauthnStore) update(change func() (bool, error)) error {
+	ws.file.Lock()
+	defer ws.file.Unlock()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if err := ws.load(true); err != nil {
+		return err
+	}
+
+	changed, err := change()
+	if err != nil || !changed {
+		return err
+	}
+
+	return ws.save()
+}
+
+// save writes the store to disk. The caller must hold both locks.
+func (ws *webauthnStore) save() error {
+
+	creds := make([]*webauthnCredential, 0, len(ws.creds))
+	for _, cred := range ws.creds {
+		creds = append(creds, cred)
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a failed write can not
+	// corrupt the existing store
+	tmp, err := os.CreateTemp(filepath.Dir(ws.path), ".trauth-webauthn-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), ws.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(ws.path); err == nil {
+		ws.modTime = info.ModTime()
+		ws.size = info.Size()
+	}
+
+	return nil
+}
+
+func (ws *webauthnStore) add(cred *webauthnCredential) error {
+	return ws.update(func() (bool, error) {
+		if _, ok := ws.creds[cred.ID]; ok {
+			return false, fmt.Errorf("credential is already registered")
+		}
+
+		ws.creds[cred.ID] = cred
+
+		return true, nil
+	})
+}
+
+func (ws *webauthnStore) get(id string) (webauthnCredential, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.refresh()
+
+	cred, ok := ws.creds[id]
+	if !ok {
+		return webauthnCredential{}, false
+	}
+
+	return *cred, true
+}
+
+func (ws *webauthnStore) forUser(username string) []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.refresh()
+
+	var ids []string
+	for id, cred := range ws.creds {
+		if cred.Username == username {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// updateCount records the signature counter of a credential after use.
+// A counter that another store already moved past is left alone.
+func (ws *webauthnStore) updateCount(id string, count uint32) error {
+	return ws.update(func() (bool, error) {
+		cred, ok := ws.creds[id]
+		if !ok || count <= cred.SignCount {
+			return false, nil
+		}
+
+		cred.SignCount = count
+
+		return true, nil
+	})
+}
+
+// pendingChallenge is a challenge sent to a client that has not been
+// answered yet.
+type pendingChallenge struct {
+	username string
+	register bool
+	expires  time.Time
+}
+
+// challengeStore holds outstanding challenges. Each one can be used once.
+type challengeStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingChallenge
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{pending: make(map[string]pendingChallenge)}
+}
+
+func (cs *challengeStore) issue(username string, register bool) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	for c, p := range cs.pending {
+		if now.After(p.expires) {
+			delete(cs.pending, c)
+		}
+	}
+
+	challenge := b64url.EncodeToString(securecookie.GenerateRandomKey(32))
+	cs.pending[challenge] = pendingChallenge{
+		username: username,
+		register: register,
+		expires:  now.Add(webauthnTimeout),
+	}
+
+	return challenge
+}
+
+func (cs *challengeStore) take(challenge string, register bool) (pendingChallenge, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	p, ok := cs.pending[challenge]
+	if !ok {
+		return p, false
+	}
+
+	delete(cs.pending, challenge)
+
+	if time.Now().After(p.expires) || p.register != register {
+		return p, false
+	}
+
+	return p, true
+}
+
+// clientData is the part of the collected client data trauth checks.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the client data of a ceremony, returning the
+// challenge it answers.
+func (c *Config) verifyClientData(raw []byte, typ string) (string, error) {
+
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", fmt.Errorf("invalid client data: %s", err)
+	}
+
+	if cd.Type != typ {
+		return "", fmt.Errorf("unexpected client data type %s", cd.Type)
+	}
+
+	origin, err := url.Parse(cd.Origin)
+	if err != nil {
+		return "", fmt.Errorf("invalid origin %s", cd.Origin)
+	}
+
+	host := strings.ToLower(origin.Hostname())
+	if host != c.WebAuthnRPID && !strings.HasSuffix(host, "."+c.WebAuthnRPID) {
+		return "", fmt.Errorf("origin %s is not part of %s", cd.Origin, c.WebAuthnRPID)
+	}
+
+	if origin.Scheme != "https" && host != "localhost" {
+		return "", fmt.Errorf("origin %s is not https", cd.Origin)
+	}
+
+	return cd.Challenge, nil
+}
+
+// authData is the parsed authenticator data of a ceremony.
+type authData struct {
+	flags     byte
+	signCount uint32
+	credID    []byte
+	publicKey []byte
+}
+
+// parseAuthData parses and checks authenticator data.
+func (c *Config) parseAuthData(raw []byte) (authData, error) {
+
+	var ad authData
+
+	if len(raw) < 37 {
+		return ad, fmt.Errorf("authenticator data too short")
+	}
+
+	rpHash := sha256.Sum256([]byte(c.WebAuthnRPID))
+	if !bytes.Equal(raw[:32], rpHash[:]) {
+		return ad, fmt.Errorf("authenticator data is for another relying party")
+	}
+
+	ad.flags = raw[32]
+	ad.signCount = binary.BigEndian.Uint32(raw[33:37])
+
+	if ad.flags&authDataUserPresent == 0 {
+		return ad, fmt.Errorf("user presence was not confirmed")
+	}
+
+	if ad.flags&authDataAttestedData == 0 {
+		return ad, nil
+	}
+
+	// aaguid, followed by the credential id length
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return ad, fmt.Errorf("attested credential data too short")
+	}
+
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return ad, fmt.Errorf("attested credential data too short")
+	}
+
+	ad.credID = rest[:idLen]
+
+	// the public key is followed by optional extension data
+	_, after, err := decodeCBOR(rest[idLen:])
+	if err != nil {
+		return ad, fmt.Errorf("invalid credential public key: %s", err)
+	}
+
+	ad.publicKey = rest[idLen : len(rest)-len(after)]
+
+	return ad, nil
+}
+
+// coseInt reads an integer from a decoded COSE key.
+func coseInt(key map[interface{}]interface{}, label int64) (int64, bool) {
+	v, ok := key[label].(int64)
+	return v, ok
+}
+
+// coseBytes reads a byte string from a decoded COSE key.
+func coseBytes(key map[interface{}]interface{}, label int64) []byte {
+	v, _ := key[label].([]byte)
+	return v
+}
+
+// parseCOSEKey converts a COSE encoded public key into a crypto key,
+// returning it with its algorithm.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("cose key is not a map")
+	}
+
+	kty, _ := coseInt(key, 1)
+	alg, _ := coseInt(key, 3)
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := coseInt(key, -1)
+		x, y := coseBytes(key, -2), coseBytes(key, -3)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("unsupported ec2 key")
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, fmt.Errorf("ec2 key is not on its curve")
+		}
+
+		return pub, alg, nil
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := coseInt(key, -1)
+		x := coseBytes(key, -2)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("unsupported okp key")
+		}
+
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseRS256:
+		n, e := coseBytes(key, -1), coseBytes(key, -2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, fmt.Errorf("unsupported rsa key")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// verifyCOSESignature checks a signature made with a COSE encoded key.
+func verifyCOSESignature(rawKey, data, sig []byte) error {
+
+	key, _, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+
+	return nil
+}
+
+// webauthnUserID derives the opaque user handle for a username.
+func webauthnUserID(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return b64url.EncodeToString(sum[:16])
+}
+
+// webauthnResponse is what the login page posts back after a ceremony.
+// Binary values are base64url encoded.
+type webauthnResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	Redirect          string `json:"rd"`
+}
+
+// readWebAuthnResponse decodes the posted json body of a ceremony.
+func readWebAuthnResponse(req *http.Request) (webauthnResponse, []byte, error) {
+
+	var resp webauthnResponse
+	if err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&resp); err != nil {
+		return resp, nil, err
+	}
+
+	cd, err := b64url.DecodeString(resp.ClientDataJSON)
+
+	return resp, cd, err
+}
+
+// webauthnError writes a json error for the login page to show.
+func webauthnError(rw http.ResponseWriter, status int, msg string) {
+	writeJSON(rw, status, map[string]string{"error": msg})
+}
+
+// serveWebAuthn handles the webauthn endpoints, returning false for paths
+// that are not one of them.
+func (t *Trauth) serveWebAuthn(rw http.ResponseWriter, req *http.Request, user User) bool {
+
+	switch req.URL.Path {
+	case webauthnRegisterBeginPath, webauthnRegisterFinishPath, webauthnLoginBeginPath, webauthnLoginFinishPath:
+	default:
+		return false
+	}
+
+	if req.Method != http.MethodPost {
+		webauthnError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return true
+	}
+
+	// a form on another site can post text/plain, but not json, and
+	// can not read the csrf token of the login page
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		webauthnError(rw, http.StatusUnsupportedMediaType, "expected a json request")
+		return true
+	}
+
+	if !nonceCookieMatches(req, t.config.csrfCookieName(), req.Header.Get(csrfHeader)) {
+		t.logger.Printf("refusing webauthn request without a valid csrf token from %s", req.RemoteAddr)
+		webauthnError(rw, http.StatusForbidden, "The page expired, reload it and try again.")
+		return true
+	}
+
+	switch req.URL.Path {
+	case webauthnRegisterBeginPath:
+		t.webauthnRegisterBegin(rw, user)
+	case webauthnRegisterFinishPath:
+		t.webauthnRegisterFinish(rw, req, user)
+	case webauthnLoginBeginPath:
+		t.webauthnLoginBegin(rw, user)
+	case webauthnLoginFinishPath:
+		t.webauthnLoginFinish(rw, req, user)
+	}
+
+	return true
+}
+
+// webauthnRegisterBegin sends the options to create a new credential.
+// only users with a session can register one.
+func (t *Trauth) webauthnRegisterBegin(rw http.ResponseWriter, user User) {
+
+	if !user.Authenticated {
+		webauthnError(rw, http.StatusUnauthorized, "login before registering a passkey")
+		return
+	}
+
+	var exclude []map[string]string
+	for _, id := range t.config.webauthn.forUser(user.Username) {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": id})
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"challenge": t.challenges.issue(user.Username, true),
+		"rp":        map[string]string{"id": t.config.WebAuthnRPID, "name": t.config.Realm},
+		"user": map[string]string{
+			"id":          webauthnUserID(user.Username),
+			"name":        user.Username,
+			"displayName": user.Username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+		"timeout":     webauthnTimeout.Milliseconds(),
+	})
+}
+
+// webauthnRegisterFinish verifies and stores a new credential.
+func (t *Trauth) webauthnRegisterFinish(rw http.ResponseWriter, req *http.Request, user User) {
+
+	resp, rawClientData, err := readWebAuthnResponse(req)
+	if err != nil {
+		webauthnError(rw, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	challenge, err := t.config.verifyClientData(rawClientData, "webauthn.create")
+	if err != nil {
+		t.logger.Printf("failed passkey registration from %s: %s", req.RemoteAddr, err)
+		webauthnError(rw, http.StatusBadRequest, "invalid client data")
+		return
+	}
+
+	pending, ok := t.challenges.take(challenge, true)
+	if !ok || !user.Authenticated || pending.username != user.Username {
+		webauthnError(rw, http.StatusUnauthorized, "unknown or expired challenge")
+		return
+	}
+
+	// the attestation statement itself is not verified, as trauth asks for
+	// no attestation. only the authenticator data in it is used.
+	rawAttestation, err := b64url.DecodeString(resp.AttestationObject)
+	if err != nil {
+		webauthnError(rw, http.StatusBadRequest, "invalid attestation")
+		return
+	}
+
+	v, _, err := decodeCBOR(rawAttestation)
+	attestation, ok := v.(map[interface{}]interface{})
+	if err != nil || !ok {
+		webauthnError(rw, http.StatusBadRequest, "invalid attestation")
+		return
+	}
+
+	rawAuthData, _ := attestation["authData"].([]byte)
+	ad, err := t.config.parseAuthData(rawAuthData)
+	if err == nil && ad.credID == nil {
+		err = fmt.Errorf("no credential in authenticator data")
+	}
+
+	if err == nil {
+		_, _, err = parseCOSEKey(ad.publicKey)
+	}
+
+	if err != nil {
+		t.logger.Printf("failed passkey registration for %s from %s: %s", user.Username, req.RemoteAddr, err)
+		webauthnError(rw, http.StatusBadRequest, "unsupported or invalid passkey")
+		return
+	}
+
+	cred := &webauthnCredential{
+		ID:        b64url.EncodeToString(ad.credID),
+		Username:  user.Username,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := t.config.webauthn.add(cred); err != nil {
+		t.logger.Printf("failed to store passkey for %s: %s", user.Username, err)
+		webauthnError(rw, http.StatusInternalServerError, "failed to store passkey")
+		return
+	}
+
+	t.logger.Printf("registered passkey for %s from %s", user.Username, req.RemoteAddr)
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "registered"})
+}
+
+// webauthnLoginBegin sends the options to assert a credential. For users
+// with a session (stepping up), only their own credentials are allowed.
+// Otherwise, the authenticator offers any passkey it has for us.
+func (t *Trauth) webauthnLoginBegin(rw http.ResponseWriter, user User) {
+
+	var username string
+	var allow []map[string]string
+
+	if user.Authenticated {
+		username = user.Username
+		for _, id := range t.config.webauthn.forUser(username) {
+			allow = append(allow, map[string]string{"type": "public-key", "id": id})
+		}
+
+		if len(allow) == 0 {
+			webauthnError(rw, http.StatusBadRequest, "no passkey is registered for "+username)
+			return
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"challenge":        t.challenges.issue(username, false),
+		"rpId":             t.config.WebAuthnRPID,
+		"allowCredentials": allow,
+		"userVerification": "preferred",
+		"timeout":          webauthnTimeout.Milliseconds(),
+	})
+}
+
+// webauthnLoginFinish verifies an assertion and creates or steps up
+// the session.
+func (t *Trauth) webauthnLoginFinish(rw http.ResponseWriter, req *http.Request, user User) {
+
+	resp, rawClientData, err := readWebAuthnResponse(req)
+	if err != nil {
+		webauthnError(rw, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	challenge, err := t.config.verifyClientData(rawClientData, "webauthn.get")
+	if err != nil {
+		t.logger.Printf("failed passkey login from %s: %s", req.RemoteAddr, err)
+		webauthnError(rw, http.StatusBadRequest, "invalid client data")
+		return
+	}
+
+	pending, ok := t.challenges.take(challenge, false)
+	if !ok {
+		webauthnError(rw, http.StatusUnauthorized, "unknown or expired challenge")
+		return
+	}
+
+	cred, ok := t.config.webauthn.get(resp.ID)
+	if !ok || (pending.username != "" && pending.username != cred.Username) {
+		t.logger.Printf("failed passkey login from %s: unknown credential", req.RemoteAddr)
+		webauthnError(rw, http.StatusUnauthorized, "unknown passkey")
+		return
+	}
+
+	rawAuthData, err := b64url.DecodeString(resp.AuthenticatorData)
+	if err != nil {
+		webauthnError(rw, http.StatusBadRequest, "invalid authenticator data")
+		return
+	}
+
+	sig, err := b64url.DecodeString(resp.Signature)
+	if err != nil {
+		webauthnError(rw, http.StatusBadRequest, "invalid signature")
+		return
+	}
+
+	ad, err := t.config.parseAuthData(rawAuthData)
+	if err == nil {
+		clientHash := sha256.Sum256(rawClientData)
+		err = verifyCOSESignature(cred.PublicKey, append(rawAuthData, clientHash[:]...), sig)
+	}
+
+	// a counter that did not increase points to a cloned authenticator.
+	// authenticators that do not keep a counter always report 0.
+	if err == nil && (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		err = fmt.Errorf("signature counter did not increase")
+	}
+
+	if err != nil {
+		t.logger.Printf("failed passkey login for %s from %s: %s", cred.Username, req.RemoteAddr, err)
+		webauthnError(rw, http.StatusUnauthorized, "passkey verification failed")
+		return
+	}
+
+	if err := t.config.webauthn.updateCount(cred.ID, ad.signCount); err != nil {
+		t.logger.Printf("failed to update passkey counter for %s: %s", cred.Username, err)
+	}
+
+	// step up an existing session for the same user, otherwise start a new one
+	if user.Authenticated && user.Username == cred.Username {
+		user.Method = joinMethods(user.Method, authMethodWebAuthn)
+		err = saveUser(t.config, user, rw, req)
+	} else {
+		_, err = setUser(t.config, cred.Username, authMethodWebAuthn, nil, rw, req)
+	}
+
+	if err != nil {
+		t.logger.Printf("failed to save user session data with: %s", err)
+		webauthnError(rw, http.StatusInternalServerError, "Failed to save the session.")
+		return
+	}
+
+	t.logger.Printf("authenticated %s from %s using a passkey", cred.Username, req.RemoteAddr)
+	writeJSON(rw, http.StatusOK, map[string]string{"rd": localRedirect(resp.Redirect)})
+}
@@ -0,0 +1,361 @@
+package trauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webauthnVector is a registration and an assertion made with a passkey
+// for the relying party example.com. The assertion has a signature
+// counter of 7 and answers the challenge "challenge-<name>".
+type webauthnVector struct {
+	name        string
+	alg         int64
+	attestation string
+	clientData  string
+	authData    string
+	signature   string
+}
+
+var webauthnVectors = []webauthnVector{
+	{
+		name:        "ES256",
+		alg:         coseES256,
+		attestation: "a363666d74646e6f6e656761747453746d74a06861757468446174615894a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce1947410000000000000000000000000000000000000000001063726564656e7469616c2d4553323536a501020326200121582010b1a1a7ed4ed5f4fe69638bc37d4d8cd056962f92a54d7685d0db2a91427b57225820ddbd06df0dca19ee2f1c1aaf549f87b3bf7f403968156529cfbbb3b2503e8ffd",
+		clientData:  `{"type":"webauthn.get","challenge":"challenge-ES256","origin":"https://example.com"}`,
+		authData:    "a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce19470100000007",
+		signature:   "304402207f588333a756df98ac3e39fc9e94a45d0fb197f0e84aaf75e180b6f2d5b15cc402204ccdeaa2b499876b5541360ed6bdc81cb12eaa3341f0ae8919f0c14d8876c0a6",
+	},
+	{
+		name:        "EdDSA",
+		alg:         coseEdDSA,
+		attestation: "a363666d74646e6f6e656761747453746d74a06861757468446174615871a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce1947410000000000000000000000000000000000000000001063726564656e7469616c2d4564445341a401010327200621582095fc87565d35a3aa91ebc46753d07d2a93eebc76f1f04ec664d57164f9db1094",
+		clientData:  `{"type":"webauthn.get","challenge":"challenge-EdDSA","origin":"https://example.com"}`,
+		authData:    "a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce19470100000007",
+		signature:   "16937e3ffb737aa401563a4f250ed1b44d4199748eae444ca112af77d8d0c630a17a88fd9288ab6347e1d3543b6cf72232ea0c60b88277ecd7b7195da297ef0c",
+	},
+	{
+		name:        "RS256",
+		alg:         coseRS256,
+		attestation: "a363666d74646e6f6e656761747453746d74a0686175746844617461590157a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce1947410000000000000000000000000000000000000000001063726564656e7469616c2d5253323536a401030339010020590100ebe67dca53286aee9e34c4602eb3419c274ba3a2e89f5f28f761b2d44fc7194efc5785411282ea03780fa34dc4efa1c71333c61e5d084487ed70f3d4fe149b7af94fa006d68c60cc875cf7f9afb3dd624e30d722b200d8a86d9895e3b308a32d013b07615fc1a650523042e6a8ee704652d1e75ed9be239aa8552168bddd84c77b5846894546ccaf99a970075b44151b944b21e91d7af466751182c8ef8df48da829ca09b0b4e913d56045ffba929df215ea3c6cc6fdec22a71bb7a615f91ec48944b3d16967912b7b3698038d00456e5fe48476d62a66b864abb1819bf15538b3e9c7b01fd2760f4e9e5cef005e7f4777f36f5acf48c4e12b86c30913c73e412143010001",
+		clientData:  `{"type":"webauthn.get","challenge":"challenge-RS256","origin":"https://example.com"}`,
+		authData:    "a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce19470100000007",
+		signature:   "aca9c2ca145f3bf0db93d46445ea26c694ea9f3ac0d0d6bd85d815fb2ec876ee0c18fb0714b534bc2404b04d307517959200e315b21954c06812b2efb5e74086b3364140579179422ed608df5c5f96de4dedc2ff8e473d40bafec295c8d8b96d14eaaa0edf5d5cdda6a040624b9de07a12fc264e8ec5985484893638055b32245fc9eb7e9476238845434e3c1e311099ce527879ee5e00bcbed0a2b6b008445501fdff6e5c659833e563188ebad924f604000e00f033c213a7178b193196925057a124227d12a7e97ebdbb505eb98df8c96bd47891c369906c33a910f5ca6f0b3db79c9975b626bacd894fc55373b81c20ef2d25b473f2fe081bc65b68b8ba41",
+	},
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func webauthnTestConfig() *Config {
+	return &Config{WebAuthnRPID: "example.com"}
+}
+
+// registeredKey returns the credential id and public key of a vector.
+func (v webauthnVector) registeredKey(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	decoded, rest, err := decodeCBOR(mustHex(t, v.attestation))
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("%s: decode attestation: %v", v.name, err)
+	}
+
+	attestation := decoded.(map[interface{}]interface{})
+	if attestation["fmt"] != "none" {
+		t.Errorf("%s: fmt = %v", v.name, attestation["fmt"])
+	}
+
+	ad, err := webauthnTestConfig().parseAuthData(attestation["authData"].([]byte))
+	if err != nil {
+		t.Fatalf("%s: parse authenticator data: %s", v.name, err)
+	}
+
+	return ad.credID, ad.publicKey
+}
+
+// signedData is what an assertion signature covers.
+func (v webauthnVector) signedData(authData []byte) []byte {
+	hash := sha256.Sum256([]byte(v.clientData))
+	return append(append([]byte(nil), authData...), hash[:]...)
+}
+
+func TestWebAuthnVectors(t *testing.T) {
+	for _, v := range webauthnVectors {
+		credID, publicKey := v.registeredKey(t)
+		if string(credID) != "credential-"+v.name {
+			t.Errorf("%s: credential id = %q", v.name, credID)
+		}
+
+		if _, alg, err := parseCOSEKey(publicKey); err != nil || alg != v.alg {
+			t.Errorf("%s: parseCOSEKey = %d, %v", v.name, alg, err)
+		}
+
+		authData := mustHex(t, v.authData)
+		ad, err := webauthnTestConfig().parseAuthData(authData)
+		if err != nil || ad.signCount != 7 || ad.credID != nil {
+			t.Errorf("%s: assertion authenticator data = %+v, %v", v.name, ad, err)
+		}
+
+		sig := mustHex(t, v.signature)
+		if err := verifyCOSESignature(publicKey, v.signedData(authData), sig); err != nil {
+			t.Errorf("%s: verify: %s", v.name, err)
+		}
+
+		// tampering with either the data or the signature fails
+		tampered := append([]byte(nil), authData...)
+		tampered[36]++
+		if err := verifyCOSESignature(publicKey, v.signedData(tampered), sig); err == nil {
+			t.Errorf("%s: tampered data verified", v.name)
+		}
+
+		sig[len(sig)-1] ^= 0xff
+		if err := verifyCOSESignature(publicKey, v.signedData(authData), sig); err == nil {
+			t.Errorf("%s: tampered signature verified", v.name)
+		}
+	}
+}
+
+func TestWebAuthnAuthDataRejections(t *testing.T) {
+	v := webauthnVectors[0]
+	authData := mustHex(t, v.authData)
+
+	other := &Config{WebAuthnRPID: "example.org"}
+	if _, err := other.parseAuthData(authData); err == nil {
+		t.Errorf("authenticator data for another rp id was accepted")
+	}
+
+	absent := append([]byte(nil), authData...)
+	absent[32] &^= authDataUserPresent
+	if _, err := webauthnTestConfig().parseAuthData(absent); err == nil {
+		t.Errorf("authenticator data without user presence was accepted")
+	}
+
+	if _, err := webauthnTestConfig().parseAuthData(authData[:36]); err == nil {
+		t.Errorf("truncated authenticator data was accepted")
+	}
+}
+
+func TestWebAuthnTruncatedCBOR(t *testing.T) {
+	for _, v := range webauthnVectors {
+		attestation := mustHex(t, v.attestation)
+		for _, n := range []int{0, 1, 10, len(attestation) - 1} {
+			if _, _, err := decodeCBOR(attestation[:n]); err == nil {
+				t.Errorf("%s: attestation truncated to %d bytes decoded", v.name, n)
+			}
+		}
+
+		decoded, _, _ := decodeCBOR(attestation)
+		authData := decoded.(map[interface{}]interface{})["authData"].([]byte)
+		if _, err := webauthnTestConfig().parseAuthData(authData[:len(authData)-1]); err == nil {
+			t.Errorf("%s: truncated credential public key was accepted", v.name)
+		}
+
+		_, publicKey := v.registeredKey(t)
+		if _, _, err := parseCOSEKey(publicKey[:len(publicKey)-1]); err == nil {
+			t.Errorf("%s: truncated cose key was accepted", v.name)
+		}
+	}
+}
+
+// newWebAuthnTestTrauth returns a trauth instance with a passkey store in
+// a temporary directory.
+func newWebAuthnTestTrauth(t *testing.T, path string) *Trauth {
+	t.Helper()
+
+	c := CreateConfig()
+	c.Domain = "example.com"
+	c.WebAuthnFile = path
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handler.(*Trauth)
+}
+
+// finishLogin posts the assertion of a vector to the login endpoint.
+func finishLogin(t *testing.T, tr *Trauth, v webauthnVector) *httptest.ResponseRecorder {
+	t.Helper()
+
+	tr.challenges.pending["challenge-"+v.name] = pendingChallenge{expires: time.Now().Add(time.Minute)}
+
+	body, _ := json.Marshal(webauthnResponse{
+		ID:                b64url.EncodeToString([]byte("credential-" + v.name)),
+		ClientDataJSON:    b64url.EncodeToString([]byte(v.clientData)),
+		AuthenticatorData: b64url.EncodeToString(mustHex(t, v.authData)),
+		Signature:         b64url.EncodeToString(mustHex(t, v.signature)),
+	})
+
+	req := httptest.NewRequest("POST", "https://example.com"+webauthnLoginFinishPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, strings.Repeat("a", 32))
+	req.AddCookie(&http.Cookie{Name: tr.config.csrfCookieName(), Value: strings.Repeat("a", 32)})
+
+	rw := httptest.NewRecorder()
+	tr.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestWebAuthnCSRF(t *testing.T) {
+	tr := newWebAuthnTestTrauth(t, filepath.Join(t.TempDir(), "passkeys.json"))
+
+	// the login page hands out the token the ceremonies are posted with
+	page := httptest.NewRecorder()
+	tr.ServeHTTP(page, httptest.NewRequest("GET", "https://example.com"+loginPath, nil))
+
+	var csrf *http.Cookie
+	for _, cookie := range page.Result().Cookies() {
+		if cookie.Name == tr.config.csrfCookieName() {
+			csrf = cookie
+		}
+	}
+
+	if csrf == nil || !strings.Contains(page.Body.String(), csrf.Value) {
+		t.Fatalf("login page did not include a csrf token")
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		token       string
+		status      int
+	}{
+		{"cross-site form", "text/plain", csrf.Value, http.StatusUnsupportedMediaType},
+		{"no content type", "", csrf.Value, http.StatusUnsupportedMediaType},
+		{"no token", "application/json", "", http.StatusForbidden},
+		{"wrong token", "application/json", strings.Repeat("0", 32), http.StatusForbidden},
+		{"login page", "application/json; charset=utf-8", csrf.Value, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "https://example.com"+webauthnLoginBeginPath, strings.NewReader("{}"))
+		req.AddCookie(csrf)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+
+		if test.token != "" {
+			req.Header.Set(csrfHeader, test.token)
+		}
+
+		rw := httptest.NewRecorder()
+		tr.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: responded %d, want %d", test.name, rw.Code, test.status)
+		}
+	}
+}
+
+func TestWebAuthnLoginCounter(t *testing.T) {
+	v := webauthnVectors[1]
+	credID, publicKey := v.registeredKey(t)
+
+	tr := newWebAuthnTestTrauth(t, filepath.Join(t.TempDir(), "passkeys.json"))
+	cred := &webauthnCredential{ID: b64url.EncodeToString(credID), Username: "alice", PublicKey: publicKey, SignCount: 8}
+	if err := tr.config.webauthn.add(cred); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vector's counter of 7 went backwards
+	if rw := finishLogin(t, tr, v); rw.Code != http.StatusUnauthorized {
+		t.Errorf("counter going backwards responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	tr = newWebAuthnTestTrauth(t, filepath.Join(t.TempDir(), "passkeys.json"))
+	cred = &webauthnCredential{ID: b64url.EncodeToString(credID), Username: "alice", PublicKey: publicKey, SignCount: 6}
+	if err := tr.config.webauthn.add(cred); err != nil {
+		t.Fatal(err)
+	}
+
+	if rw := finishLogin(t, tr, v); rw.Code != http.StatusOK {
+		t.Fatalf("login responded %d: %s", rw.Code, rw.Body)
+	}
+
+	if stored, _ := tr.config.webauthn.get(cred.ID); stored.SignCount != 7 {
+		t.Errorf("stored counter = %d, want 7", stored.SignCount)
+	}
+
+	if rw := finishLogin(t, tr, v); rw.Code != http.StatusUnauthorized {
+		t.Errorf("replayed assertion responded %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWebAuthnStoresShareFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passkeys.json")
+
+	// two routers, or an instance from before a configuration reload
+	a, err := newWebAuthnStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newWebAuthnStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.add(&webauthnCredential{ID: "one", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.add(&webauthnCredential{ID: "two", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.updateCount("one", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.add(&webauthnCredential{ID: "one", Username: "alice"}); err == nil {
+		t.Errorf("a credential registered by another store was registered again")
+	}
+
+	fresh, err := newWebAuthnStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"one", "two"} {
+		if _, ok := fresh.get(id); !ok {
+			t.Errorf("credential %s was lost", id)
+		}
+	}
+
+	if cred, _ := fresh.get("one"); cred.SignCount != 3 {
+		t.Errorf("counter = %d, want 3", cred.SignCount)
+	}
+
+	// a stale counter update does not move the counter back
+	if err := b.updateCount("one", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if cred, _ := b.get("one"); cred.SignCount != 3 {
+		t.Errorf("counter = %d after a stale update, want 3", cred.SignCount)
+	}
+
+	if ids := b.forUser("alice"); len(ids) != 1 {
+		t.Errorf("store does not see credentials added by another: %q", ids)
+	}
+}
@@ -0,0 +1,61 @@
+package trauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const whoamiPath = reservedPath + `whoami`
+
+// whoami is the response for the session introspection endpoint.
+type whoami struct {
+	Authenticated bool       `json:"authenticated"`
+	Username      string     `json:"username,omitempty"`
+	Groups        []string   `json:"groups,omitempty"`
+	Method        string     `json:"method,omitempty"`
+	IssuedAt      *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+}
+
+// writeJSON writes v as a json response with the given status code.
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+// serveWhoami describes the session of the current client so that
+// frontends can show who is logged in and when that will expire.
+func (t *Trauth) serveWhoami(rw http.ResponseWriter, user User) {
+
+	if !user.Authenticated {
+		writeJSON(rw, http.StatusUnauthorized, whoami{Authenticated: false})
+		return
+	}
+
+	resp := whoami{
+		Authenticated: true,
+		Username:      user.Username,
+		Groups:        user.Groups,
+		Method:        user.Method,
+	}
+
+	if !user.IssuedAt.IsZero() {
+		issued := user.IssuedAt
+		resp.IssuedAt = &issued
+
+		// the cookie expires max age after it was last written, which
+		// sessions from before SavedAt was recorded can only estimate
+		saved := user.SavedAt
+		if saved.IsZero() {
+			saved = issued
+		}
+
+		expires := saved.Add(time.Duration(t.config.cookieStore.Options.MaxAge) * time.Second)
+		resp.ExpiresAt = &expires
+	}
+
+	writeJSON(rw, http.StatusOK, resp)
+}
@@ -0,0 +1,53 @@
+package trauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWhoamiExpiry(t *testing.T) {
+	c := CreateConfig()
+	c.Domain = "example.com"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := New(context.Background(), next, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := handler.(*Trauth)
+
+	// a session that logged in a day ago, and was written again since
+	issued := time.Now().Add(-24 * time.Hour).UTC()
+	login := httptest.NewRecorder()
+	user := User{Username: "alice", Authenticated: true, Method: authMethodBasic, IssuedAt: issued}
+	if err := saveUser(tr.config, user, login, httptest.NewRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com"+whoamiPath, nil)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	var resp whoami
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.ExpiresAt == nil || resp.IssuedAt == nil {
+		t.Fatalf("responded %d with %+v (%v)", rw.Code, resp, err)
+	}
+
+	if !resp.IssuedAt.Equal(issued) {
+		t.Errorf("issued_at is %s, want %s", resp.IssuedAt, issued)
+	}
+
+	maxAge := time.Duration(tr.config.cookieStore.Options.MaxAge) * time.Second
+	if want := time.Now().Add(maxAge); resp.ExpiresAt.Before(want.Add(-time.Minute)) || resp.ExpiresAt.After(want) {
+		t.Errorf("expires_at is %s, want about %s", resp.ExpiresAt, want)
+	}
+}